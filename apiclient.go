@@ -2,18 +2,38 @@ package common
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
 const DEFAULT_IDLE_CONN_TIMEOUT = 5
 const DEFAULT_DISABLE_KEEPALIVES = false
+const DEFAULT_DISABLE_COMPRESSION = false
+const DEFAULT_COMPRESS_REQUESTS = ""
+const DEFAULT_COMPRESS_MIN_SIZE = 1024
+const DEFAULT_COOKIE_JAR = false
+const DEFAULT_COOKIE_PERSIST = true
+const DEFAULT_RETRY_COUNT = 0
+const DEFAULT_RETRY_DELAY = 1
+const DEFAULT_RETRY_MAX_DELAY = 60
+const DEFAULT_IDEMPOTENCY_KEYS = false
+const DEFAULT_NETRC = false
+
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
 
 type APIClient interface {
 	Close()
@@ -23,17 +43,28 @@ type APIClient interface {
 	Delete(path string, response interface{}) (string, error)
 	SetFlag(string, bool) error
 	StatusCode() (int, bool)
+	ClearCookies() error
 }
 
 type client struct {
-	c              *http.Client
-	URL            string
-	Headers        map[string]string
-	verbose        bool
-	debug          bool
-	Flags          map[string]bool
-	flagNames      []string
-	lastStatusCode int
+	c               *http.Client
+	URL             string
+	Headers         map[string]string
+	verbose         bool
+	debug           bool
+	Flags           map[string]bool
+	flagNames       []string
+	lastStatusCode  int
+	compress        string
+	compressMin     int
+	noCompression   bool
+	jar             *cookieJar
+	retryCount      int
+	retryDelay      time.Duration
+	retryMaxDelay   time.Duration
+	idempotencyKeys bool
+	netrcLogin      string
+	netrcPassword   string
 }
 
 func NewAPIClient(prefix, url, certFile, keyFile, caFile string, headers *map[string]string) (APIClient, error) {
@@ -58,10 +89,35 @@ func NewAPIClient(prefix, url, certFile, keyFile, caFile string, headers *map[st
 
 	ViperSetDefault(prefix+"api_client.idle_conn_timeout", DEFAULT_IDLE_CONN_TIMEOUT)
 	ViperSetDefault(prefix+"api_client.disable_keepalives", DEFAULT_DISABLE_KEEPALIVES)
+	ViperSetDefault(prefix+"api_client.disable_compression", DEFAULT_DISABLE_COMPRESSION)
+	ViperSetDefault(prefix+"api_client.compress_requests", DEFAULT_COMPRESS_REQUESTS)
+	ViperSetDefault(prefix+"api_client.compress_min_size", DEFAULT_COMPRESS_MIN_SIZE)
+
+	ViperSetDefault(prefix+"api_client.retry_count", DEFAULT_RETRY_COUNT)
+	ViperSetDefault(prefix+"api_client.retry_delay", DEFAULT_RETRY_DELAY)
+	ViperSetDefault(prefix+"api_client.retry_max_delay", DEFAULT_RETRY_MAX_DELAY)
+	ViperSetDefault(prefix+"api_client.idempotency_keys", DEFAULT_IDEMPOTENCY_KEYS)
+
+	api.retryCount = ViperGetInt(prefix + "api_client.retry_count")
+	api.retryDelay = time.Duration(ViperGetInt64(prefix+"api_client.retry_delay")) * time.Second
+	api.retryMaxDelay = time.Duration(ViperGetInt64(prefix+"api_client.retry_max_delay")) * time.Second
+	api.idempotencyKeys = ViperGetBool(prefix + "api_client.idempotency_keys")
+
+	api.noCompression = ViperGetBool(prefix + "api_client.disable_compression")
+	api.compress = strings.ToLower(ViperGetString(prefix + "api_client.compress_requests"))
+	api.compressMin = ViperGetInt(prefix + "api_client.compress_min_size")
+	// zstd is not offered: the standard library has no zstd codec, and zstd
+	// responses are passed through undecoded
+	switch api.compress {
+	case "", "gzip", "deflate":
+	default:
+		return nil, Fatalf("unsupported request compression: %s", api.compress)
+	}
 
 	transport := http.Transport{
-		IdleConnTimeout:   time.Duration(ViperGetInt64(prefix+"api_client.idle_conn_timeout")) * time.Second,
-		DisableKeepAlives: ViperGetBool(prefix + "api_client.disable_keepalives"),
+		IdleConnTimeout:    time.Duration(ViperGetInt64(prefix+"api_client.idle_conn_timeout")) * time.Second,
+		DisableKeepAlives:  ViperGetBool(prefix + "api_client.disable_keepalives"),
+		DisableCompression: api.noCompression,
 	}
 
 	if certFile != "" || keyFile != "" || caFile != "" {
@@ -99,14 +155,85 @@ func NewAPIClient(prefix, url, certFile, keyFile, caFile string, headers *map[st
 
 	api.c = &http.Client{Transport: &transport}
 
+	ViperSetDefault(prefix+"api_client.cookie_jar", DEFAULT_COOKIE_JAR)
+	ViperSetDefault(prefix+"api_client.cookie_persist", DEFAULT_COOKIE_PERSIST)
+	if ViperGetBool(prefix + "api_client.cookie_jar") {
+		var cookieFile string
+		if ViperGetBool(prefix + "api_client.cookie_persist") {
+			cookieFile = ViperGetString(prefix + "api_client.cookie_file")
+			if cookieFile == "" {
+				var err error
+				cookieFile, err = defaultCookieFile()
+				if err != nil {
+					return nil, Fatal(err)
+				}
+			}
+			if api.debug {
+				log.Printf("cookies: %s\n", cookieFile)
+			}
+		}
+		jar, err := newCookieJar(cookieFile)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		api.jar = jar
+		api.c.Jar = jar
+	}
+
+	ViperSetDefault(prefix+"api_client.netrc", DEFAULT_NETRC)
+	if ViperGetBool(prefix + "api_client.netrc") {
+		err := api.loadNetrc(prefix)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+
 	return &api, nil
 }
 
+// set basic auth credentials from the .netrc entry matching the URL host
+func (c *client) loadNetrc(prefix string) error {
+	filename, err := netrcFilename(prefix)
+	if err != nil {
+		return Fatal(err)
+	}
+	if !IsFile(filename) {
+		if c.debug {
+			log.Printf("netrc: %s not found\n", filename)
+		}
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return Fatalf("failed parsing URL: %v", err)
+	}
+	entries, err := readNetrc(filename)
+	if err != nil {
+		return Fatal(err)
+	}
+	entry, ok := lookupNetrc(entries, u.Hostname())
+	if ok && entry.Login != "" {
+		c.netrcLogin = entry.Login
+		c.netrcPassword = entry.Password
+		if c.debug {
+			log.Printf("netrc: %s login=%s\n", u.Hostname(), entry.Login)
+		}
+	}
+	return nil
+}
+
 func (c *client) Close() {
 	c.c.CloseIdleConnections()
 	c.c = nil
 }
 
+func (c *client) ClearCookies() error {
+	if c.jar == nil {
+		return nil
+	}
+	return c.jar.Clear()
+}
+
 func (c *client) SetFlag(name string, value bool) error {
 	for flagName, _ := range c.Flags {
 		if name == flagName {
@@ -151,48 +278,125 @@ func (c *client) request(method, path string, requestData, responseData interfac
 		}
 	}
 
-	request, err := http.NewRequest(method, c.URL+path, bytes.NewBuffer(requestBytes))
-	if err != nil {
-		return "", Fatalf("failed creating %s request: %v", method, err)
+	// compress the request body if configured and large enough to be worth it
+	sendBytes := requestBytes
+	var contentEncoding string
+	if c.compress != "" && len(requestBytes) > 0 && len(requestBytes) >= c.compressMin {
+		sendBytes, err = encodeBody(c.compress, requestBytes)
+		if err != nil {
+			return "", Fatal(err)
+		}
+		contentEncoding = c.compress
+	}
+
+	requestHeader := http.Header{}
+	if contentEncoding != "" {
+		requestHeader.Set("Content-Encoding", contentEncoding)
 	}
 
 	// add the headers set up at instance init
 	for key, value := range c.Headers {
-		request.Header.Add(key, value)
+		requestHeader.Set(key, value)
 	}
 
 	if headers != nil {
-		// add the headers passed in to this request
+		// the headers passed in to this request replace those from init
 		for key, value := range *headers {
-			request.Header.Add(key, value)
+			requestHeader.Set(key, value)
 		}
 	}
 
-	if c.verbose {
-		log.Printf("<-- %s %s (%d bytes)", method, c.URL+path, len(requestBytes))
-		if c.debug {
-			log.Println("BEGIN-REQUEST-HEADER")
-			for key, value := range request.Header {
-				log.Printf("%s: %s\n", key, value)
+	// request compressed responses explicitly so the transport leaves decoding
+	// to us and the compressed size can be logged
+	if !c.noCompression && requestHeader.Get("Accept-Encoding") == "" {
+		requestHeader.Set("Accept-Encoding", "gzip")
+	}
+
+	// a caller-supplied key is used as-is; a generated key is shared by all
+	// retries of this call so the server can discard duplicates
+	idempotencyKey := requestHeader.Get(IDEMPOTENCY_KEY_HEADER)
+	if idempotencyKey == "" && c.idempotencyKeys && isMutatingMethod(method) {
+		idempotencyKey = uuid.New().String()
+		requestHeader.Set(IDEMPOTENCY_KEY_HEADER, idempotencyKey)
+	}
+
+	// mutating requests are only retried when the server can detect duplicates
+	retryable := !isMutatingMethod(method) || idempotencyKey != ""
+
+	var response *http.Response
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest(method, c.URL+path, bytes.NewBuffer(sendBytes))
+		if err != nil {
+			return "", Fatalf("failed creating %s request: %v", method, err)
+		}
+		request.Header = requestHeader.Clone()
+		if c.netrcLogin != "" && request.Header.Get("Authorization") == "" {
+			request.SetBasicAuth(c.netrcLogin, c.netrcPassword)
+		}
+
+		if c.verbose {
+			var detail string
+			if idempotencyKey != "" {
+				detail += " key=" + idempotencyKey
+			}
+			if attempt > 0 {
+				detail += fmt.Sprintf(" retry=%d", attempt)
+			}
+			log.Printf("<-- %s %s (%s)%s", method, c.URL+path, formatByteCount(len(requestBytes), contentEncoding, len(sendBytes)), detail)
+			if c.debug {
+				log.Println("BEGIN-REQUEST-HEADER")
+				for key, value := range request.Header {
+					log.Printf("%s: %s\n", key, value)
+				}
+				log.Println("END-REQUEST-HEADER")
+				log.Println("BEGIN-REQUEST-BODY")
+				log.Println(string(requestBytes))
+				log.Println("END-REQUEST-BODY")
 			}
-			log.Println("END-REQUEST-HEADER")
-			log.Println("BEGIN-REQUEST-BODY")
-			log.Println(string(requestBytes))
-			log.Println("END-REQUEST-BODY")
 		}
-	}
 
-	response, err := c.c.Do(request)
-	if err != nil {
-		return "", Fatalf("request failed: %v", err)
+		response, body, err = c.send(request)
+		if !retryable || attempt >= c.retryCount || !isRetryableResponse(response, err) {
+			if err != nil {
+				return "", Fatal(err)
+			}
+			break
+		}
+		delay := c.retryBackoff(attempt)
+		if c.verbose {
+			var reason string
+			if err != nil {
+				reason = err.Error()
+			} else {
+				reason = response.Status
+			}
+			log.Printf("retrying %s %s in %v: %s\n", method, c.URL+path, delay, reason)
+		}
+		time.Sleep(delay)
 	}
-	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return "", Fatalf("failure reading response body: %v", err)
+
+	receivedBytes := len(body)
+	responseEncoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	switch responseEncoding {
+	case "gzip", "x-gzip", "deflate":
+		// HEAD, 204, and 304 responses may carry the header without a body
+		if len(body) > 0 {
+			body, err = decodeBody(responseEncoding, body)
+			if err != nil {
+				return "", Fatal(err)
+			}
+		}
+	case "", "identity":
+		responseEncoding = ""
+	default:
+		if c.debug {
+			log.Printf("passing through response with unsupported content encoding: %s\n", responseEncoding)
+		}
+		responseEncoding = ""
 	}
 	if c.verbose {
-		log.Printf("--> '%s' (%d bytes)\n", response.Status, len(body))
+		log.Printf("--> '%s' (%s)\n", response.Status, formatByteCount(len(body), responseEncoding, receivedBytes))
 		if c.debug {
 			log.Println("BEGIN-RESPONSE-BODY")
 			log.Println(string(body))
@@ -232,3 +436,108 @@ func (c *client) request(method, path string, requestData, responseData interfac
 	}
 	return text, nil
 }
+
+// perform the request, returning the response with its body read and closed
+func (c *client) send(request *http.Request) (*http.Response, []byte, error) {
+	response, err := c.c.Do(request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure reading response body: %v", err)
+	}
+	return response, body, nil
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+func isRetryableResponse(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// the delay before retry attempt+1: retryDelay doubled per attempt and
+// capped at retryMaxDelay, less up to a quarter as jitter so clients that
+// failed together do not retry together
+func (c *client) retryBackoff(attempt int) time.Duration {
+	delay := c.retryDelay
+	for i := 0; i < attempt && delay < c.retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > c.retryMaxDelay {
+		delay = c.retryMaxDelay
+	}
+	if jitter := delay / 4; jitter > 0 {
+		delay -= rand.N(jitter)
+	}
+	return delay
+}
+
+func formatByteCount(size int, encoding string, encodedSize int) string {
+	if encoding == "" {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	return fmt.Sprintf("%d bytes, %s %d bytes", size, encoding, encodedSize)
+}
+
+func encodeBody(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	default:
+		return nil, Fatalf("unsupported content encoding: %s", encoding)
+	}
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBody(encoding string, data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, Fatalf("failed decoding %s response: %v", encoding, err)
+		}
+		reader = r
+	case "deflate":
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, Fatalf("failed decoding %s response: %v", encoding, err)
+		}
+		reader = r
+	default:
+		return nil, Fatalf("unsupported response content encoding: %s", encoding)
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, Fatalf("failed decoding %s response: %v", encoding, err)
+	}
+	return decoded, nil
+}
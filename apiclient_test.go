@@ -0,0 +1,246 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIClientCompression(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("api_client.compress_requests", "gzip")
+	ViperSet("api_client.compress_min_size", 0)
+	ViperSet("api_client.disable_compression", true)
+	defer func() {
+		ViperSet("api_client.compress_requests", DEFAULT_COMPRESS_REQUESTS)
+		ViperSet("api_client.compress_min_size", DEFAULT_COMPRESS_MIN_SIZE)
+		ViperSet("api_client.disable_compression", DEFAULT_DISABLE_COMPRESSION)
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		reader, err := gzip.NewReader(r.Body)
+		require.Nil(t, err)
+		data, err := io.ReadAll(reader)
+		require.Nil(t, err)
+		var request map[string]string
+		err = json.Unmarshal(data, &request)
+		require.Nil(t, err)
+
+		// respond compressed even though the client did not ask for it
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		err = json.NewEncoder(writer).Encode(map[string]string{"echo": request["message"]})
+		require.Nil(t, err)
+		err = writer.Close()
+		require.Nil(t, err)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	api, err := NewAPIClient("", server.URL, "", "", "", nil)
+	require.Nil(t, err)
+	defer api.Close()
+
+	var response map[string]string
+	_, err = api.Post("/echo", map[string]string{"message": "howdy"}, &response, nil)
+	require.Nil(t, err)
+	require.Equal(t, "howdy", response["echo"])
+}
+
+func TestAPIClientCookieJar(t *testing.T) {
+	initTestConfig(t)
+	cookieFile := filepath.Join(t.TempDir(), "cookies.json")
+	ViperSet("api_client.cookie_jar", true)
+	ViperSet("api_client.cookie_file", cookieFile)
+	defer ViperSet("api_client.cookie_jar", DEFAULT_COOKIE_JAR)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cr3t", Path: "/"})
+			http.SetCookie(w, &http.Cookie{Name: "stale", Value: "gone", Path: "/", MaxAge: -1})
+		case "/check":
+			cookie, err := r.Cookie("session")
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(cookie.Value))
+		}
+	}))
+	defer server.Close()
+
+	api, err := NewAPIClient("", server.URL, "", "", "", nil)
+	require.Nil(t, err)
+	_, err = api.Post("/login", nil, nil, nil)
+	require.Nil(t, err)
+	api.Close()
+
+	info, err := os.Stat(cookieFile)
+	require.Nil(t, err)
+	if runtime.GOOS != "windows" {
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// a new client should pick up the session from the cookie file
+	api, err = NewAPIClient("", server.URL, "", "", "", nil)
+	require.Nil(t, err)
+	defer api.Close()
+	text, err := api.Get("/check", nil)
+	require.Nil(t, err)
+	require.Equal(t, "s3cr3t", text)
+
+	err = api.ClearCookies()
+	require.Nil(t, err)
+	require.False(t, IsFile(cookieFile))
+	api.Get("/check", nil)
+	code, _ := api.StatusCode()
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestAPIClientIdempotencyKey(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("api_client.retry_count", 2)
+	ViperSet("api_client.retry_delay", 0)
+	ViperSet("api_client.idempotency_keys", true)
+	defer func() {
+		ViperSet("api_client.retry_count", DEFAULT_RETRY_COUNT)
+		ViperSet("api_client.retry_delay", DEFAULT_RETRY_DELAY)
+		ViperSet("api_client.idempotency_keys", DEFAULT_IDEMPOTENCY_KEYS)
+	}()
+
+	keys := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(IDEMPOTENCY_KEY_HEADER))
+		// fail every other request
+		if len(keys)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("created"))
+	}))
+	defer server.Close()
+
+	api, err := NewAPIClient("", server.URL, "", "", "", nil)
+	require.Nil(t, err)
+	defer api.Close()
+
+	text, err := api.Post("/create", map[string]int{"n": 1}, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, "created", text)
+	require.Len(t, keys, 2)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+
+	headers := map[string]string{IDEMPOTENCY_KEY_HEADER: "caller-key"}
+	_, err = api.Put("/update", map[string]int{"n": 2}, nil, &headers)
+	require.Nil(t, err)
+	require.Equal(t, []string{"caller-key", "caller-key"}, keys[2:])
+}
+
+func TestAPIClientNetrc(t *testing.T) {
+	initTestConfig(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		require.True(t, ok)
+		w.Write([]byte(username + ":" + password))
+	}))
+	defer server.Close()
+	host, _, _ := strings.Cut(strings.TrimPrefix(server.URL, "http://"), ":")
+
+	netrcFile := filepath.Join(t.TempDir(), "netrc")
+	netrc := "machine example.com login nobody password nothing\n" +
+		"macdef init\ncd /pub\n\n" +
+		"machine " + host + "\n  login howdy\n  password s3cr3t\n" +
+		"default login anonymous password guest\n"
+	err := os.WriteFile(netrcFile, []byte(netrc), 0600)
+	require.Nil(t, err)
+
+	ViperSet("api_client.netrc", true)
+	ViperSet("api_client.netrc_file", netrcFile)
+	defer ViperSet("api_client.netrc", DEFAULT_NETRC)
+
+	api, err := NewAPIClient("", server.URL, "", "", "", nil)
+	require.Nil(t, err)
+	defer api.Close()
+	text, err := api.Get("/", nil)
+	require.Nil(t, err)
+	require.Equal(t, "howdy:s3cr3t", text)
+
+	entries, err := readNetrc(netrcFile)
+	require.Nil(t, err)
+	entry, ok := lookupNetrc(entries, "unknown.example.org")
+	require.True(t, ok)
+	require.Equal(t, "anonymous", entry.Login)
+
+	// the config value and NETRC are expanded alike
+	home, err := os.UserHomeDir()
+	require.Nil(t, err)
+	t.Setenv("NETRC_DIR", filepath.Dir(netrcFile))
+	ViperSet("api_client.netrc_file", "$NETRC_DIR/netrc")
+	filename, err := netrcFilename("")
+	require.Nil(t, err)
+	require.Equal(t, netrcFile, filename)
+	ViperSet("api_client.netrc_file", "~/netrc")
+	filename, err = netrcFilename("")
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(home, "netrc"), filename)
+	ViperSet("api_client.netrc_file", "")
+	t.Setenv("NETRC", "~/netrc")
+	filename, err = netrcFilename("")
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(home, "netrc"), filename)
+}
+
+func TestAPIClientResponseEncoding(t *testing.T) {
+	initTestConfig(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusNoContent)
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(`{"encoding":"br"}`))
+		}
+	}))
+	defer server.Close()
+
+	api, err := NewAPIClient("", server.URL, "", "", "", nil)
+	require.Nil(t, err)
+	defer api.Close()
+	api.SetFlag("require_json", false)
+
+	_, err = api.Get("/empty", nil)
+	require.Nil(t, err)
+
+	var response map[string]string
+	_, err = api.Get("/br", &response)
+	require.Nil(t, err)
+	require.Equal(t, "br", response["encoding"])
+}
+
+func TestAPIClientRetryBackoff(t *testing.T) {
+	c := client{retryDelay: time.Second, retryMaxDelay: time.Minute}
+	for attempt, seconds := range []time.Duration{1, 2, 4, 8, 16, 32, 60, 60, 60} {
+		if attempt == 8 {
+			// large attempt counts must not overflow the shift
+			attempt = 1000
+		}
+		delay := c.retryBackoff(attempt)
+		require.LessOrEqual(t, delay, seconds*time.Second)
+		require.GreaterOrEqual(t, delay, seconds*time.Second*3/4)
+	}
+}
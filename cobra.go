@@ -160,8 +160,9 @@ func CobraAddCommand(cobraRootCmd, parentCmd, cobraCmd CobraCommand) {
 	parent.AddCommand(cmd)
 }
 
-// call from root cobra command init
-func CobraInit(cobraRootCmd CobraCommand) {
+// call from root cobra command init; options add optional commands:
+// COBRA_OPTION_MAIL adds the mail send and mail test subcommands
+func CobraInit(cobraRootCmd CobraCommand, options ...string) {
 
 	root := toCobraCmd("CobraInit", "cobraRootCmd", cobraRootCmd)
 	switch rootCmd {
@@ -169,6 +170,7 @@ func CobraInit(cobraRootCmd CobraCommand) {
 		rootCmd = root
 	case root:
 		// rootCmd has already been set by a call to CobraAddCommand
+		cobraInitOptions(options)
 		return
 	default:
 		// rootCmd must match if non-nil
@@ -198,4 +200,6 @@ func CobraInit(cobraRootCmd CobraCommand) {
 	CobraAddCommand(rootCmd, configCmd, configEditCmd)
 	CobraAddCommand(rootCmd, configCmd, configFileCmd)
 	CobraAddCommand(rootCmd, configCmd, configInitCmd)
+
+	cobraInitOptions(options)
 }
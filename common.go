@@ -36,6 +36,7 @@ func Shutdown() {
 
 // internal shutdown
 func shutdown() {
+	closeErrorMail()
 	closeLog()
 }
 
@@ -67,14 +68,57 @@ func ConfigDir() string {
 	return strings.TrimRight(dir, string(filepath.Separator))
 }
 
+// the cache_dir config value, defaulting to the user cache dir
+func cacheDir() (string, error) {
+	dir := ViperGetString("cache_dir")
+	if dir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return "", Fatal(err)
+		}
+		dir = filepath.Join(userCache, ProgramName())
+	}
+	return dir, nil
+}
+
+// write data to a temp file in the same directory and rename it into place
+func writeFileAtomic(filename string, data []byte, mode os.FileMode) error {
+	fp, err := os.CreateTemp(filepath.Dir(filename), ".tmp-*")
+	if err != nil {
+		return Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	err = fp.Chmod(mode)
+	if err != nil {
+		fp.Close()
+		return Fatal(err)
+	}
+	_, err = fp.Write(data)
+	if err != nil {
+		fp.Close()
+		return Fatal(err)
+	}
+	err = fp.Close()
+	if err != nil {
+		return Fatal(err)
+	}
+	err = os.Rename(fp.Name(), filename)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
 func CheckErr(err error) {
 	if err != nil {
 		log.Printf("Error: %v\n", err)
+		closeErrorMail()
 		os.Exit(1)
 	}
 }
 
 func openLog() {
+	closeErrorMail()
 	filename := ViperGetString("logfile")
 	LogFile = nil
 	if filename == "stdout" || filename == "-" {
@@ -95,6 +139,7 @@ func openLog() {
 	if ViperGetBool("debug") {
 		log.SetFlags(log.Flags() | log.Llongfile)
 	}
+	openErrorMail()
 }
 
 func closeLog() {
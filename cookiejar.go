@@ -0,0 +1,172 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DEFAULT_COOKIE_FILE = "cookies.json"
+
+// cookieJar wraps the standard library jar, recording every cookie it is
+// given so the set can be written to disk and replayed on the next run
+type cookieJar struct {
+	jar      *cookiejar.Jar
+	filename string
+	entries  map[string]cookieEntry
+	mutex    sync.Mutex
+}
+
+type cookieEntry struct {
+	URL    string       `json:"url"`
+	Cookie *http.Cookie `json:"cookie"`
+}
+
+func defaultCookieFile() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", Fatal(err)
+	}
+	return filepath.Join(dir, DEFAULT_COOKIE_FILE), nil
+}
+
+// an empty filename creates a jar that is not persisted
+func newCookieJar(filename string) (*cookieJar, error) {
+	j := cookieJar{
+		filename: filename,
+		entries:  make(map[string]cookieEntry),
+	}
+	err := j.reset()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if filename == "" || !IsFile(filename) {
+		return &j, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	entries := []cookieEntry{}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, Fatalf("failed decoding cookie file %s: %v", filename, err)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.Cookie == nil || isExpiredCookie(entry.Cookie, now) {
+			continue
+		}
+		u, err := url.Parse(entry.URL)
+		if err != nil {
+			continue
+		}
+		j.jar.SetCookies(u, []*http.Cookie{entry.Cookie})
+		j.entries[cookieKey(u, entry.Cookie)] = entry
+	}
+	return &j, nil
+}
+
+func (j *cookieJar) reset() error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return Fatal(err)
+	}
+	j.jar = jar
+	j.entries = make(map[string]cookieEntry)
+	return nil
+}
+
+func cookieKey(u *url.URL, cookie *http.Cookie) string {
+	return u.Host + ";" + cookie.Domain + ";" + cookie.Path + ";" + cookie.Name
+}
+
+func isExpiredCookie(cookie *http.Cookie, now time.Time) bool {
+	return !cookie.Expires.IsZero() && !cookie.Expires.After(now)
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.jar.SetCookies(u, cookies)
+	now := time.Now()
+	origin := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	for _, cookie := range cookies {
+		saved := *cookie
+		// convert Max-Age to an absolute expiry so it survives a restart
+		switch {
+		case saved.MaxAge < 0:
+			saved.Expires = now
+		case saved.MaxAge > 0:
+			saved.Expires = now.Add(time.Duration(saved.MaxAge) * time.Second)
+		}
+		saved.MaxAge = 0
+		key := cookieKey(u, &saved)
+		if isExpiredCookie(&saved, now) {
+			delete(j.entries, key)
+			continue
+		}
+		j.entries[key] = cookieEntry{URL: origin.String(), Cookie: &saved}
+	}
+	err := j.save()
+	if err != nil {
+		Warning("%v", err)
+	}
+}
+
+func (j *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.jar.Cookies(u)
+}
+
+func (j *cookieJar) Clear() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	err := j.reset()
+	if err != nil {
+		return Fatal(err)
+	}
+	if j.filename != "" {
+		err := os.Remove(j.filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return Fatal(err)
+		}
+	}
+	return nil
+}
+
+// write the unexpired cookies to the cookie file
+func (j *cookieJar) save() error {
+	if j.filename == "" {
+		return nil
+	}
+	now := time.Now()
+	entries := []cookieEntry{}
+	for key, entry := range j.entries {
+		if isExpiredCookie(entry.Cookie, now) {
+			delete(j.entries, key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(j.filename), 0700)
+	if err != nil {
+		return Fatal(err)
+	}
+	err = writeFileAtomic(j.filename, data, 0600)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
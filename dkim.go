@@ -0,0 +1,342 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// headers signed when present, in signing order
+var DKIMSignedHeaders = []string{
+	"From", "Sender", "Reply-To", "Subject", "Date", "Message-ID", "To", "Cc",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner adds a DKIM-Signature header using rsa-sha256 or ed25519-sha256
+// with relaxed/relaxed canonicalization
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	Headers  []string
+}
+
+// load the PEM private key from keyFile; PKCS#1 and PKCS#8 RSA keys and
+// PKCS#8 Ed25519 keys are accepted
+func NewDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, Fatalf("no PEM data found in %s", keyFile)
+	}
+	var key crypto.Signer
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, Fatalf("failed parsing %s: %v", keyFile, err)
+		}
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, Fatalf("failed parsing %s: %v", keyFile, err)
+		}
+		switch parsed.(type) {
+		case *rsa.PrivateKey, ed25519.PrivateKey:
+			key = parsed.(crypto.Signer)
+		default:
+			return nil, Fatalf("unsupported DKIM key type %T in %s", parsed, keyFile)
+		}
+	default:
+		return nil, Fatalf("unsupported PEM block '%s' in %s", block.Type, keyFile)
+	}
+	return &DKIMSigner{
+		Domain:   domain,
+		Selector: selector,
+		Key:      key,
+		Headers:  DKIMSignedHeaders,
+	}, nil
+}
+
+// return a signer configured by the smtp.dkim section, or nil if the
+// section has no selector
+func newDKIMSignerFromConfig(prefix string) (*DKIMSigner, error) {
+	selector := ViperGetString(prefix + "smtp.dkim.selector")
+	if selector == "" {
+		return nil, nil
+	}
+	missing := []string{}
+	for _, key := range []string{"domain", "key_file"} {
+		if ViperGetString(prefix+"smtp.dkim."+key) == "" {
+			missing = append(missing, ViperKey(prefix+"smtp.dkim."+key))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, Fatalf("missing config: %s", strings.Join(missing, ", "))
+	}
+	signer, err := NewDKIMSigner(
+		ViperGetString(prefix+"smtp.dkim.domain"),
+		selector,
+		ViperGetString(prefix+"smtp.dkim.key_file"),
+	)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	headers := ViperGetStringSlice(prefix + "smtp.dkim.headers")
+	if len(headers) > 0 {
+		signer.Headers = headers
+	}
+	return signer, nil
+}
+
+func dkimAlgorithm(key interface{}) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", Fatalf("unsupported DKIM key type %T", key)
+}
+
+// return the DNS TXT record value publishing the public key
+func DKIMPublicKeyRecord(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	}
+	return "", Fatalf("unsupported DKIM key type %T", publicKey)
+}
+
+// return the message with a DKIM-Signature header prepended
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	algorithm, err := dkimAlgorithm(s.Key)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	fields, body := splitMessage(message)
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+
+	names := []string{}
+	var hashed bytes.Buffer
+	used := make(map[string]int)
+	for _, name := range s.Headers {
+		field, ok := selectHeaderField(fields, name, used)
+		if !ok {
+			continue
+		}
+		names = append(names, name)
+		hashed.WriteString(canonicalHeaderRelaxed(field))
+	}
+	if len(names) == 0 {
+		return nil, Fatalf("message has none of the headers to be signed")
+	}
+
+	header := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, s.Domain, s.Selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	hashed.WriteString(strings.TrimSuffix(canonicalHeaderRelaxed(header), "\r\n"))
+	digest := sha256.Sum256(hashed.Bytes())
+
+	var signature []byte
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, digest[:])
+	}
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	buf.WriteString(foldBase64(base64.StdEncoding.EncodeToString(signature)))
+	buf.WriteString("\r\n")
+	buf.Write(message)
+	return buf.Bytes(), nil
+}
+
+// check the first DKIM-Signature in the message against publicKey without
+// any DNS lookup
+func DKIMVerify(message []byte, publicKey crypto.PublicKey) error {
+	fields, body := splitMessage(message)
+	var signatureField string
+	for _, field := range fields {
+		if strings.EqualFold(headerFieldName(field), "DKIM-Signature") {
+			signatureField = field
+			break
+		}
+	}
+	if signatureField == "" {
+		return Fatalf("message has no DKIM-Signature")
+	}
+	_, value, _ := strings.Cut(signatureField, ":")
+	tags := parseDKIMTags(value)
+
+	algorithm, err := dkimAlgorithm(publicKey)
+	if err != nil {
+		return Fatal(err)
+	}
+	if tags["a"] != algorithm {
+		return Fatalf("DKIM algorithm '%s' does not match %s key", tags["a"], algorithm)
+	}
+	if tags["c"] != "relaxed/relaxed" {
+		return Fatalf("unsupported DKIM canonicalization: %s", tags["c"])
+	}
+
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return Fatalf("DKIM body hash mismatch")
+	}
+
+	var hashed bytes.Buffer
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		field, ok := selectHeaderField(fields, strings.TrimSpace(name), used)
+		if ok {
+			hashed.WriteString(canonicalHeaderRelaxed(field))
+		}
+	}
+	unsigned := dkimSignatureValue.ReplaceAllString(signatureField, "${1}${2}")
+	hashed.WriteString(strings.TrimSuffix(canonicalHeaderRelaxed(unsigned), "\r\n"))
+	digest := sha256.Sum256(hashed.Bytes())
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return Fatalf("invalid DKIM signature encoding: %v", err)
+	}
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return Fatalf("DKIM signature verification failed: %v", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest[:], signature) {
+			return Fatalf("DKIM signature verification failed")
+		}
+	}
+	return nil
+}
+
+// matches the value of the b= tag, leaving bh= alone
+var dkimSignatureValue = regexp.MustCompile(`(?s)(^|;|:)(\s*b\s*=)[^;]*`)
+
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		// whitespace is not significant anywhere in tag values used here
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+// split a message into its raw header fields, each including any folded
+// continuation lines and the trailing CRLF, and the body
+func splitMessage(message []byte) ([]string, []byte) {
+	text := string(message)
+	headerText, body, found := strings.Cut(text, "\r\n\r\n")
+	if !found {
+		return splitHeaderFields(text), nil
+	}
+	return splitHeaderFields(headerText + "\r\n"), []byte(body)
+}
+
+func splitHeaderFields(text string) []string {
+	fields := []string{}
+	for _, line := range strings.SplitAfter(text, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func headerFieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// select the next instance of the named header, working up from the bottom
+// as each repeated name in the signed list consumes one
+func selectHeaderField(fields []string, name string, used map[string]int) (string, bool) {
+	key := strings.ToLower(name)
+	skip := used[key]
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.ToLower(headerFieldName(fields[i])) != key {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		used[key]++
+		return fields[i], true
+	}
+	return "", false
+}
+
+var foldingWhitespace = regexp.MustCompile(`[ \t]+`)
+
+func canonicalHeaderRelaxed(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = foldingWhitespace.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value) + "\r\n"
+}
+
+func canonicalBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(foldingWhitespace.ReplaceAllString(line, " "), " ")
+	}
+	// drop trailing empty lines
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// fold a long base64 value across continuation lines
+func foldBase64(value string) string {
+	var buf strings.Builder
+	for len(value) > 72 {
+		buf.WriteString(value[:72] + "\r\n\t")
+		value = value[72:]
+	}
+	buf.WriteString(value)
+	return buf.String()
+}
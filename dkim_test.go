@@ -0,0 +1,96 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	require.Nil(t, err)
+	return keyFile
+}
+
+func TestDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	message, err := formatMessage(&Message{
+		From:    "Sender <sender@example.com>",
+		To:      []string{"rcpt@example.com"},
+		Subject: "signed  message",
+		Body:    []byte("howdy  \n\n.leading dot\n\n\n"),
+	}, "")
+	require.Nil(t, err)
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		signer, err := NewDKIMSigner("example.com", "test", writeTestKey(t, key))
+		require.Nil(t, err)
+		signed, err := signer.Sign(message)
+		require.Nil(t, err)
+		require.True(t, strings.HasPrefix(string(signed), "DKIM-Signature: v=1;"))
+
+		err = DKIMVerify(signed, key.Public())
+		require.Nil(t, err)
+
+		// relaxed canonicalization tolerates whitespace changes
+		relaxed := bytes.Replace(signed, []byte("Subject: signed  message"), []byte("subject:  signed message "), 1)
+		err = DKIMVerify(relaxed, key.Public())
+		require.Nil(t, err)
+
+		tampered := bytes.Replace(signed, []byte("howdy"), []byte("hello"), 1)
+		err = DKIMVerify(tampered, key.Public())
+		require.NotNil(t, err)
+
+		tampered = bytes.Replace(signed, []byte("Subject: signed"), []byte("Subject: forged"), 1)
+		err = DKIMVerify(tampered, key.Public())
+		require.NotNil(t, err)
+
+		record, err := DKIMPublicKeyRecord(key.Public())
+		require.Nil(t, err)
+		require.True(t, strings.HasPrefix(record, "v=DKIM1; k="))
+	}
+}
+
+func TestDKIMSendmail(t *testing.T) {
+	initTestConfig(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	fileDir := t.TempDir()
+	ViperSet("dkim.smtp.transport", SMTP_TRANSPORT_FILE)
+	ViperSet("dkim.smtp.file_dir", fileDir)
+	ViperSet("dkim.smtp.dkim.selector", "test")
+	_, err = NewSendmailFromConfig("dkim.")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "go_common.dkim.smtp.dkim.domain")
+
+	ViperSet("dkim.smtp.dkim.domain", "example.com")
+	ViperSet("dkim.smtp.dkim.key_file", writeTestKey(t, key))
+	s, err := NewSendmailFromConfig("dkim.")
+	require.Nil(t, err)
+	err = s.Send("rcpt@example.com", "sender@example.com", "dkim", []byte("howdy\n"))
+	require.Nil(t, err)
+
+	files, err := filepath.Glob(filepath.Join(fileDir, "*.eml"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	err = DKIMVerify(data, key.Public())
+	require.Nil(t, err)
+}
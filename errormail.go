@@ -0,0 +1,280 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_ERROR_MAIL_LEVEL = "warning"
+const DEFAULT_ERROR_MAIL_INTERVAL = 300
+const DEFAULT_ERROR_MAIL_MAX_MAILS = 10
+const DEFAULT_ERROR_MAIL_MAX_LINES = 100
+
+// log line levels for the error_mail.level config key
+const LOG_LEVEL_INFO = "info"
+const LOG_LEVEL_WARNING = "warning"
+const LOG_LEVEL_ERROR = "error"
+
+var logLevels = map[string]int{LOG_LEVEL_INFO: 0, LOG_LEVEL_WARNING: 1, LOG_LEVEL_ERROR: 2}
+
+// errorMailHook sits between the log package and its output, collecting
+// lines at or above the configured level and mailing them in batches no
+// more often than once per interval, and at shutdown.  Lines logged by
+// flush itself while a batch is being sent are not collected, so a failing
+// mail setup cannot feed itself; other goroutines are collected as usual.
+type errorMailHook struct {
+	output    io.Writer
+	level     int
+	to        []string
+	from      string
+	subject   string
+	interval  time.Duration
+	maxMails  int
+	maxLines  int
+	newSender func() (Sendmail, error)
+	mutex     sync.Mutex
+	flushing  sync.Mutex
+	lines     []string
+	dropped   int
+	lastSent  time.Time
+	mails     int
+	timer     *time.Timer
+	sending   bool
+}
+
+var errorMail *errorMailHook
+
+// install the hook when error_mail.to is configured
+func openErrorMail() {
+	to := ViperGetStringSlice("error_mail.to")
+	if len(to) == 0 {
+		return
+	}
+	ViperSetDefault("error_mail.level", DEFAULT_ERROR_MAIL_LEVEL)
+	ViperSetDefault("error_mail.interval", DEFAULT_ERROR_MAIL_INTERVAL)
+	ViperSetDefault("error_mail.max_mails", DEFAULT_ERROR_MAIL_MAX_MAILS)
+	ViperSetDefault("error_mail.max_lines", DEFAULT_ERROR_MAIL_MAX_LINES)
+	level, ok := logLevels[strings.ToLower(ViperGetString("error_mail.level"))]
+	if !ok {
+		Warning("error mail disabled: unknown level '%s'", ViperGetString("error_mail.level"))
+		return
+	}
+	from := ViperGetString("error_mail.from")
+	if from == "" && strings.Contains(ViperGetString("smtp.username"), "@") {
+		from = ViperGetString("smtp.username")
+	}
+	if from == "" {
+		Warning("error mail disabled: missing config: %s", ViperKey("error_mail.from"))
+		return
+	}
+	subject := ViperGetString("error_mail.subject_prefix")
+	if subject == "" {
+		subject = "[" + ProgramName() + "]"
+	}
+	h := errorMailHook{
+		output:    log.Writer(),
+		level:     level,
+		to:        to,
+		from:      from,
+		subject:   subject,
+		interval:  time.Duration(ViperGetInt64("error_mail.interval")) * time.Second,
+		maxMails:  ViperGetInt("error_mail.max_mails"),
+		maxLines:  ViperGetInt("error_mail.max_lines"),
+		newSender: func() (Sendmail, error) { return NewSendmailFromConfig("") },
+	}
+	errorMail = &h
+	log.SetOutput(errorMail)
+}
+
+// send anything still collected and remove the hook
+func closeErrorMail() {
+	if errorMail == nil {
+		return
+	}
+	h := errorMail
+	errorMail = nil
+	h.mutex.Lock()
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.mutex.Unlock()
+	h.flush()
+	if log.Writer() == h {
+		log.SetOutput(h.output)
+	}
+}
+
+func (h *errorMailHook) Write(p []byte) (int, error) {
+	n, err := h.output.Write(p)
+	h.collect(p)
+	return n, err
+}
+
+func (h *errorMailHook) collect(p []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.sending && onFlushPath() {
+		return
+	}
+	added := false
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if strings.TrimSpace(line) == "" || logLineLevel(line) < h.level {
+			continue
+		}
+		if h.maxLines > 0 && len(h.lines) >= h.maxLines {
+			h.dropped++
+			continue
+		}
+		h.lines = append(h.lines, line)
+		added = true
+	}
+	// an interval of zero defers everything to shutdown
+	if added && h.timer == nil && h.interval > 0 {
+		delay := time.Until(h.lastSent.Add(h.interval))
+		if delay < 0 {
+			delay = 0
+		}
+		h.timer = time.AfterFunc(delay, h.flush)
+	}
+}
+
+// report whether the caller was reached from flush, meaning the line was
+// logged by the mail transport while sending a batch
+func onFlushPath() bool {
+	pc := make([]uintptr, 64)
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		frame, more := frames.Next()
+		if strings.HasSuffix(frame.Function, ".(*errorMailHook).flush") {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// classify a log line by the markers written by Warning and CheckErr
+func logLineLevel(line string) int {
+	upper := strings.ToUpper(line)
+	switch {
+	case strings.Contains(upper, "ERROR:") || strings.Contains(upper, "FATAL:"):
+		return logLevels[LOG_LEVEL_ERROR]
+	case strings.Contains(upper, "WARNING:"):
+		return logLevels[LOG_LEVEL_WARNING]
+	}
+	return logLevels[LOG_LEVEL_INFO]
+}
+
+// the message of a log line without the prefix, date, time, and file
+// written by the standard logger's flags; continuation lines are unchanged
+func logLineMessage(line string) string {
+	flags := log.Flags()
+	if flags&log.Lmsgprefix == 0 {
+		line = strings.TrimPrefix(line, log.Prefix())
+	}
+	if flags&log.Ldate != 0 {
+		date, rest, ok := strings.Cut(line, " ")
+		if _, err := time.Parse("2006/01/02", date); ok && err == nil {
+			line = rest
+		}
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		clock, rest, ok := strings.Cut(line, " ")
+		if _, err := time.Parse("15:04:05", clock); ok && err == nil {
+			line = rest
+		}
+	}
+	if flags&(log.Llongfile|log.Lshortfile) != 0 {
+		file, rest, ok := strings.Cut(line, ": ")
+		if ok && strings.Contains(file, ".go:") {
+			line = rest
+		}
+	}
+	if flags&log.Lmsgprefix != 0 {
+		line = strings.TrimPrefix(line, log.Prefix())
+	}
+	return line
+}
+
+func (h *errorMailHook) flush() {
+	h.flushing.Lock()
+	defer h.flushing.Unlock()
+
+	h.mutex.Lock()
+	h.timer = nil
+	lines := h.lines
+	dropped := h.dropped
+	h.lines = nil
+	h.dropped = 0
+	if len(lines) == 0 || (h.maxMails > 0 && h.mails >= h.maxMails) {
+		h.mutex.Unlock()
+		return
+	}
+	h.mails++
+	h.sending = true
+	h.mutex.Unlock()
+
+	err := h.send(lines, dropped)
+
+	h.mutex.Lock()
+	h.sending = false
+	h.lastSent = time.Now()
+	h.mutex.Unlock()
+
+	// report directly to the log output so the failure is not collected
+	if err != nil {
+		fmt.Fprintf(h.output, "WARNING: error mail failed: %v\n", err)
+	}
+}
+
+func (h *errorMailHook) send(lines []string, dropped int) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	var body bytes.Buffer
+	body.WriteString(fmt.Sprintf("%s v%s on %s\n\n", ProgramName(), ProgramVersion(), hostname))
+	for _, line := range lines {
+		body.WriteString(line + "\n")
+	}
+	if dropped > 0 {
+		body.WriteString(fmt.Sprintf("\n(%d more lines not shown)\n", dropped))
+	}
+	if h.maxMails > 0 && h.mails >= h.maxMails {
+		body.WriteString("\n(mail limit reached; further lines will not be mailed)\n")
+	}
+
+	summary := logLineMessage(lines[0])
+	if runes := []rune(summary); len(runes) > 80 {
+		summary = string(runes[:80]) + "..."
+	}
+	if len(lines)+dropped > 1 {
+		summary = fmt.Sprintf("%s (+%d more)", summary, len(lines)+dropped-1)
+	}
+
+	sender, err := h.newSender()
+	if err != nil {
+		return Fatal(err)
+	}
+	defer sender.Close()
+	err = sender.SendMessage(&Message{
+		From:    h.from,
+		To:      h.to,
+		Subject: h.subject + " " + summary,
+		Body:    body.Bytes(),
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestErrorMail(t *testing.T) {
+	initTestConfig(t)
+	fileDir := t.TempDir()
+	ViperSet("smtp.transport", SMTP_TRANSPORT_FILE)
+	ViperSet("smtp.file_dir", fileDir)
+	ViperSet("error_mail.to", []string{"operator@example.com"})
+	ViperSet("error_mail.from", "cron@example.com")
+	ViperSet("error_mail.interval", 0)
+	defer func() {
+		ViperSet("smtp.transport", "")
+		ViperSet("error_mail.to", []string{})
+		ViperSet("error_mail.from", "")
+	}()
+
+	openErrorMail()
+	require.NotNil(t, errorMail)
+	log.Println("routine status line")
+	Warning("disk nearly full")
+	log.Printf("Error: backup failed\n")
+	closeErrorMail()
+	require.Nil(t, errorMail)
+
+	files, err := filepath.Glob(filepath.Join(fileDir, "*.eml"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	require.Contains(t, string(data), "Subject: [go-common] WARNING: disk nearly full (+1 more)\r\n")
+	require.Contains(t, string(data), "WARNING: disk nearly full")
+	require.Contains(t, string(data), "Error: backup failed")
+	require.NotContains(t, string(data), "routine status line")
+}
+
+func TestErrorMailLogLineMessage(t *testing.T) {
+	flags := log.Flags()
+	prefix := log.Prefix()
+	defer func() {
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	}()
+
+	log.SetFlags(log.LstdFlags)
+	log.SetPrefix("")
+	require.Equal(t, "WARNING: disk full", logLineMessage("2026/10/19 08:00:00 WARNING: disk full"))
+	require.Equal(t, "continued", logLineMessage("continued"))
+
+	log.SetPrefix("[42] ")
+	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lmsgprefix | log.Llongfile)
+	require.Equal(t, "Error: failed", logLineMessage("2026/10/19 08:00:00.123456 /src/app/main.go:12: [42] Error: failed"))
+
+	log.SetFlags(log.Ltime | log.Lshortfile)
+	require.Equal(t, "Error: failed", logLineMessage("[42] 08:00:00 main.go:12: Error: failed"))
+}
+
+func TestErrorMailThrottle(t *testing.T) {
+	initTestConfig(t)
+	var calls atomic.Int32
+	h := &errorMailHook{
+		output:   io.Discard,
+		level:    logLevels[LOG_LEVEL_WARNING],
+		to:       []string{"operator@example.com"},
+		from:     "cron@example.com",
+		interval: 50 * time.Millisecond,
+		maxMails: 2,
+	}
+	// a failing mail setup that logs must not trigger another mail
+	h.newSender = func() (Sendmail, error) {
+		calls.Add(1)
+		h.Write([]byte("WARNING: relay unavailable\n"))
+		return nil, errors.New("relay unavailable")
+	}
+
+	h.Write([]byte("WARNING: first\n"))
+	h.Write([]byte("WARNING: second\n"))
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(1), calls.Load())
+
+	h.Write([]byte("info only\n"))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(1), calls.Load())
+
+	h.Write([]byte("WARNING: third\n"))
+	require.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, 5*time.Millisecond)
+
+	// the mail limit has been reached
+	h.Write([]byte("WARNING: fourth\n"))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestErrorMailConcurrentLines(t *testing.T) {
+	initTestConfig(t)
+	sending := make(chan bool)
+	logged := make(chan bool)
+	bodies := make(chan string, 1)
+	h := &errorMailHook{
+		output: io.Discard,
+		level:  logLevels[LOG_LEVEL_WARNING],
+		to:     []string{"operator@example.com"},
+		from:   "cron@example.com",
+	}
+	h.newSender = func() (Sendmail, error) {
+		h.Write([]byte("WARNING: logged by the mail transport\n"))
+		sending <- true
+		<-logged
+		return &errorMailRecorder{bodies: bodies}, nil
+	}
+
+	h.Write([]byte("WARNING: first\n"))
+	go h.flush()
+	<-sending
+	// a line from another goroutine during the send is kept for the next batch
+	h.Write([]byte("ERROR: during send\n"))
+	logged <- true
+	require.Contains(t, <-bodies, "WARNING: first")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	require.Equal(t, []string{"ERROR: during send"}, h.lines)
+}
+
+// errorMailRecorder passes message bodies to the test
+type errorMailRecorder struct {
+	SendmailFile
+	bodies chan string
+}
+
+func (r *errorMailRecorder) SendMessage(msg *Message) error {
+	r.bodies <- string(msg.Body)
+	return nil
+}
+
+func (r *errorMailRecorder) Close() error {
+	return nil
+}
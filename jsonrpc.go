@@ -0,0 +1,230 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+const JSONRPC_VERSION = "2.0"
+
+// standard JSON-RPC 2.0 error codes
+const (
+	JSONRPC_PARSE_ERROR      = -32700
+	JSONRPC_INVALID_REQUEST  = -32600
+	JSONRPC_METHOD_NOT_FOUND = -32601
+	JSONRPC_INVALID_PARAMS   = -32602
+	JSONRPC_INTERNAL_ERROR   = -32603
+)
+
+type JSONRPCClient interface {
+	Call(method string, params, result interface{}) error
+	Notify(method string, params interface{}) error
+	CallBatch(batch *JSONRPCBatch) error
+}
+
+// JSONRPCError is the error object returned by the server; use errors.As to
+// recover it from the error returned by Call or CallBatch
+type JSONRPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	if len(e.Data) > 0 {
+		return fmt.Sprintf("JSON-RPC error %d: %s: %s", e.Code, e.Message, string(e.Data))
+	}
+	return fmt.Sprintf("JSON-RPC error %d: %s", e.Code, e.Message)
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      *uint64     `json:"id,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *JSONRPCError   `json:"error"`
+	ID      *uint64         `json:"id"`
+}
+
+type jsonrpcClient struct {
+	api     APIClient
+	path    string
+	lastID  atomic.Uint64
+	headers map[string]string
+}
+
+// JSONRPCBatch collects calls and notifications to be sent in one request
+type JSONRPCBatch struct {
+	calls []*jsonrpcCall
+}
+
+type jsonrpcCall struct {
+	method string
+	params interface{}
+	result interface{}
+	notify bool
+	err    error
+}
+
+// requests are posted to path using the TLS config, headers, and logging of api
+func NewJSONRPCClient(api APIClient, path string) JSONRPCClient {
+	return &jsonrpcClient{
+		api:     api,
+		path:    path,
+		headers: map[string]string{"Content-Type": "application/json"},
+	}
+}
+
+func NewJSONRPCBatch() *JSONRPCBatch {
+	return &JSONRPCBatch{}
+}
+
+// add a call to the batch, returning the index used to retrieve its error
+func (b *JSONRPCBatch) Call(method string, params, result interface{}) int {
+	b.calls = append(b.calls, &jsonrpcCall{method: method, params: params, result: result})
+	return len(b.calls) - 1
+}
+
+func (b *JSONRPCBatch) Notify(method string, params interface{}) {
+	b.calls = append(b.calls, &jsonrpcCall{method: method, params: params, notify: true})
+}
+
+func (b *JSONRPCBatch) Len() int {
+	return len(b.calls)
+}
+
+// the error returned for the call at index after CallBatch
+func (b *JSONRPCBatch) Err(index int) error {
+	return b.calls[index].err
+}
+
+func (c *jsonrpcClient) nextID() *uint64 {
+	id := c.lastID.Add(1)
+	return &id
+}
+
+func (c *jsonrpcClient) post(request, response interface{}) error {
+	_, err := c.api.Post(c.path, request, response, &c.headers)
+	if err != nil {
+		return Fatal(err)
+	}
+	status, ok := c.api.StatusCode()
+	if !ok && !hasJSONRPCError(response) {
+		return Fatalf("JSON-RPC request failed: HTTP status %d", status)
+	}
+	return nil
+}
+
+// servers commonly send the error object with an HTTP error status
+func hasJSONRPCError(response interface{}) bool {
+	switch r := response.(type) {
+	case *jsonrpcResponse:
+		return r.Error != nil
+	case *[]jsonrpcResponse:
+		for _, item := range *r {
+			if item.Error != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *jsonrpcClient) Call(method string, params, result interface{}) error {
+	id := c.nextID()
+	request := jsonrpcRequest{JSONRPC: JSONRPC_VERSION, Method: method, Params: params, ID: id}
+	var response jsonrpcResponse
+	err := c.post(&request, &response)
+	if err != nil {
+		return Fatal(err)
+	}
+	if response.Error == nil && (response.ID == nil || *response.ID != *id) {
+		return Fatalf("JSON-RPC %s: response id mismatch", method)
+	}
+	return decodeJSONRPCResponse(method, &response, result)
+}
+
+func (c *jsonrpcClient) Notify(method string, params interface{}) error {
+	request := jsonrpcRequest{JSONRPC: JSONRPC_VERSION, Method: method, Params: params}
+	err := c.post(&request, nil)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+// send all calls in the batch; the first call error is returned, and each
+// call's error is available from batch.Err
+func (c *jsonrpcClient) CallBatch(batch *JSONRPCBatch) error {
+	if batch.Len() == 0 {
+		return Fatalf("JSON-RPC batch is empty")
+	}
+	pending := make(map[uint64]*jsonrpcCall)
+	requests := []jsonrpcRequest{}
+	for _, call := range batch.calls {
+		request := jsonrpcRequest{JSONRPC: JSONRPC_VERSION, Method: call.method, Params: call.params}
+		if !call.notify {
+			request.ID = c.nextID()
+			pending[*request.ID] = call
+		}
+		requests = append(requests, request)
+		call.err = nil
+	}
+
+	// the server sends no response to a batch containing only notifications
+	if len(pending) == 0 {
+		return c.post(&requests, nil)
+	}
+
+	var responses []jsonrpcResponse
+	err := c.post(&requests, &responses)
+	if err != nil {
+		return Fatal(err)
+	}
+	var batchErr error
+	for _, response := range responses {
+		if response.ID == nil {
+			// the server could not identify the request
+			if response.Error != nil && batchErr == nil {
+				batchErr = response.Error
+			}
+			continue
+		}
+		call, ok := pending[*response.ID]
+		if !ok {
+			return Fatalf("JSON-RPC batch: unexpected response id %d", *response.ID)
+		}
+		delete(pending, *response.ID)
+		call.err = decodeJSONRPCResponse(call.method, &response, call.result)
+	}
+	for _, call := range pending {
+		call.err = Fatalf("JSON-RPC %s: no response", call.method)
+	}
+	for _, call := range batch.calls {
+		if call.err != nil {
+			return call.err
+		}
+	}
+	return batchErr
+}
+
+func decodeJSONRPCResponse(method string, response *jsonrpcResponse, result interface{}) error {
+	if response.Error != nil {
+		// returned unwrapped so callers can use errors.As
+		return response.Error
+	}
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(response.Result, result)
+	if err != nil {
+		return Fatalf("JSON-RPC %s: failed decoding result: %v", method, err)
+	}
+	return nil
+}
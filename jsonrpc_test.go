@@ -0,0 +1,114 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func jsonrpcTestHandler(t *testing.T, notified *[]string) http.HandlerFunc {
+	handle := func(request map[string]json.RawMessage) map[string]any {
+		var method string
+		json.Unmarshal(request["method"], &method)
+		id, ok := request["id"]
+		if !ok {
+			*notified = append(*notified, method)
+			return nil
+		}
+		response := map[string]any{"jsonrpc": "2.0", "id": id}
+		switch method {
+		case "echo":
+			response["result"] = request["params"]
+		case "fail":
+			response["error"] = map[string]any{"code": JSONRPC_INTERNAL_ERROR, "message": "internal error"}
+		default:
+			response["error"] = map[string]any{"code": JSONRPC_METHOD_NOT_FOUND, "message": "method not found", "data": method}
+		}
+		return response
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, []string{"application/json"}, r.Header.Values("Content-Type"))
+		data, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		var result any
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			var requests []map[string]json.RawMessage
+			require.Nil(t, json.Unmarshal(data, &requests))
+			responses := []map[string]any{}
+			for _, request := range requests {
+				if response := handle(request); response != nil {
+					responses = append(responses, response)
+				}
+			}
+			if len(responses) > 0 {
+				result = responses
+			}
+		} else {
+			var request map[string]json.RawMessage
+			require.Nil(t, json.Unmarshal(data, &request))
+			if response := handle(request); response != nil {
+				result = response
+			}
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if bytes.Contains(data, []byte(`"fail"`)) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func TestJSONRPCClient(t *testing.T) {
+	initTestConfig(t)
+	notified := []string{}
+	server := httptest.NewServer(jsonrpcTestHandler(t, &notified))
+	defer server.Close()
+
+	// the JSON-RPC content type replaces one set on the client
+	api, err := NewAPIClient("", server.URL, "", "", "", &map[string]string{"Content-Type": "text/plain"})
+	require.Nil(t, err)
+	defer api.Close()
+	rpc := NewJSONRPCClient(api, "/rpc")
+
+	var echo []string
+	err = rpc.Call("echo", []string{"howdy"}, &echo)
+	require.Nil(t, err)
+	require.Equal(t, []string{"howdy"}, echo)
+
+	err = rpc.Call("missing", nil, nil)
+	var rpcErr *JSONRPCError
+	require.True(t, errors.As(err, &rpcErr))
+	require.Equal(t, JSONRPC_METHOD_NOT_FOUND, rpcErr.Code)
+	require.Equal(t, `"missing"`, string(rpcErr.Data))
+
+	err = rpc.Call("fail", nil, nil)
+	require.True(t, errors.As(err, &rpcErr))
+	require.Equal(t, JSONRPC_INTERNAL_ERROR, rpcErr.Code)
+
+	err = rpc.Notify("ping", nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"ping"}, notified)
+
+	batch := NewJSONRPCBatch()
+	var first, second map[string]int
+	i1 := batch.Call("echo", map[string]int{"n": 1}, &first)
+	batch.Notify("tick", nil)
+	i2 := batch.Call("echo", map[string]int{"n": 2}, &second)
+	i3 := batch.Call("missing", nil, nil)
+	err = rpc.CallBatch(batch)
+	require.True(t, errors.As(err, &rpcErr))
+	require.Nil(t, batch.Err(i1))
+	require.Nil(t, batch.Err(i2))
+	require.NotNil(t, batch.Err(i3))
+	require.Equal(t, 1, first["n"])
+	require.Equal(t, 2, second["n"])
+	require.Equal(t, []string{"ping", "tick"}, notified)
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strings"
+)
+
+// CobraInit options
+const COBRA_OPTION_MAIL = "mail"
+
+var mailCmd = &cobra.Command{
+	Use:   "mail",
+	Short: "mail subcommands",
+	Long: `
+subcommands for sending mail and checking the smtp config section
+`,
+}
+
+var mailSendCmd = &cobra.Command{
+	Use:   "send [BODY_FILE]",
+	Short: "send a message",
+	Long: `
+send a message using the smtp config section.  The body is read from
+BODY_FILE, or from stdin when BODY_FILE is omitted or '-'.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename := "-"
+		if len(args) > 0 {
+			filename = args[0]
+		}
+		var body []byte
+		var err error
+		if filename == "-" {
+			body, err = io.ReadAll(os.Stdin)
+		} else {
+			body, err = os.ReadFile(filename)
+		}
+		CheckErr(err)
+		msg, err := mailSendMessage(
+			ViperGetString("send.from"),
+			ViperGetStringSlice("send.to"),
+			ViperGetStringSlice("send.cc"),
+			ViperGetString("send.subject"),
+			ViperGetStringSlice("send.attach"),
+			body,
+		)
+		CheckErr(err)
+		sender, err := NewSendmailFromConfig("")
+		CheckErr(err)
+		// end the session before CheckErr can exit
+		err = sender.SendMessage(msg)
+		closeErr := sender.Close()
+		CheckErr(err)
+		CheckErr(closeErr)
+		if ViperGetBool("verbose") {
+			fmt.Printf("sent to %s\n", strings.Join(append(msg.To, msg.Cc...), ", "))
+		}
+	},
+}
+
+var mailTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "check the smtp settings",
+	Long: `
+connect and authenticate using the smtp config section, then write the
+server's capabilities as JSON without sending a message
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sender, err := NewSendmailFromConfig("")
+		CheckErr(err)
+		client, ok := sender.(*SendmailClient)
+		if !ok {
+			CheckErr(fmt.Errorf("smtp.transport '%s' does not use an SMTP server", ViperGetString("smtp.transport")))
+		}
+		status, err := client.Verify(context.Background())
+		closeErr := client.Close()
+		CheckErr(err)
+		CheckErr(closeErr)
+		fmt.Println(FormatJSON(status))
+	},
+}
+
+// add the commands selected by CobraInit options; safe to call again
+func cobraInitOptions(options []string) {
+	for _, option := range options {
+		switch option {
+		case COBRA_OPTION_MAIL:
+			if mailCmd.HasParent() {
+				continue
+			}
+			CobraAddCommand(rootCmd, rootCmd, mailCmd)
+			CobraAddCommand(rootCmd, mailCmd, mailSendCmd)
+			OptionString(mailSendCmd, "from", "f", "", "sender address (default smtp.username)")
+			OptionStringSlice(mailSendCmd, "to", "t", []string{}, "recipient address")
+			OptionStringSlice(mailSendCmd, "cc", "c", []string{}, "copy recipient address")
+			OptionString(mailSendCmd, "subject", "s", "", "message subject")
+			OptionStringSlice(mailSendCmd, "attach", "a", []string{}, "attach file")
+			CobraAddCommand(rootCmd, mailCmd, mailTestCmd)
+		default:
+			cobra.CheckErr(fmt.Errorf("CobraInit: unknown option '%s'", option))
+		}
+	}
+}
+
+// build the message for mail send
+func mailSendMessage(from string, to, cc []string, subject string, attach []string, body []byte) (*Message, error) {
+	if from == "" {
+		from = ViperGetString("smtp.username")
+	}
+	if !strings.Contains(from, "@") {
+		return nil, Fatalf("missing sender address; use --from")
+	}
+	if len(to) == 0 && len(cc) == 0 {
+		return nil, Fatalf("missing recipient address; use --to")
+	}
+	msg := Message{
+		From:    from,
+		To:      to,
+		Cc:      cc,
+		Subject: subject,
+		Body:    body,
+	}
+	for _, filename := range attach {
+		err := msg.Attach(filename)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	return &msg, nil
+}
@@ -0,0 +1,28 @@
+package common
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMailSendMessage(t *testing.T) {
+	initTestConfig(t)
+	attachment := filepath.Join(t.TempDir(), "report.txt")
+	require.Nil(t, os.WriteFile(attachment, []byte("report\n"), 0600))
+
+	msg, err := mailSendMessage("sender@example.com", []string{"rcpt@example.com"}, []string{"copy@example.com"}, "ad-hoc", []string{attachment}, []byte("howdy\n"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"copy@example.com"}, msg.Cc)
+	require.Len(t, msg.Attachments, 1)
+	require.Equal(t, "report.txt", msg.Attachments[0].Filename)
+
+	_, err = mailSendMessage("sender@example.com", nil, nil, "no recipients", nil, []byte("howdy\n"))
+	require.NotNil(t, err)
+
+	ViperSet("smtp.username", "")
+	defer ViperSet("smtp.username", "${SMTP_USERNAME}")
+	_, err = mailSendMessage("", []string{"rcpt@example.com"}, nil, "no sender", nil, []byte("howdy\n"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,360 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// nesting limit for multipart bodies
+const MAX_MIME_DEPTH = 32
+
+// ParsedMessage is a received message with its headers decoded and its
+// MIME structure walked.  Header holds the raw header fields; the address
+// and Subject fields are decoded from RFC 2047.  A malformed address or Date
+// header leaves its field empty rather than failing the parse, since bounces
+// and replies often carry them.
+type ParsedMessage struct {
+	Header    mail.Header
+	From      []*mail.Address
+	Sender    *mail.Address
+	To        []*mail.Address
+	Cc        []*mail.Address
+	ReplyTo   []*mail.Address
+	Subject   string
+	Date      time.Time
+	MessageID string
+	Root      *MessagePart
+}
+
+// MessagePart is one node of the MIME tree.  Body holds the content with
+// the transfer encoding removed; multipart nodes have Parts instead.
+type MessagePart struct {
+	Header      textproto.MIMEHeader
+	ContentType string
+	Params      map[string]string
+	Disposition string
+	Filename    string
+	ContentID   string
+	Body        []byte
+	Parts       []*MessagePart
+}
+
+// DSNRecipient is the per-recipient section of a delivery status report
+type DSNRecipient struct {
+	FinalRecipient    string
+	OriginalRecipient string
+	Action            string
+	Status            string
+	DiagnosticCode    string
+	RemoteMTA         string
+}
+
+// ParseMessage reads an RFC 5322 message
+func ParseMessage(r io.Reader) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	m := ParsedMessage{Header: msg.Header}
+	for _, field := range []struct {
+		name string
+		list *[]*mail.Address
+	}{
+		{"From", &m.From},
+		{"To", &m.To},
+		{"Cc", &m.Cc},
+		{"Reply-To", &m.ReplyTo},
+	} {
+		addrs, err := msg.Header.AddressList(field.name)
+		if err == nil {
+			*field.list = addrs
+		}
+	}
+	if msg.Header.Get("Sender") != "" {
+		sender, err := mail.ParseAddress(msg.Header.Get("Sender"))
+		if err == nil {
+			m.Sender = sender
+		}
+	}
+	m.Subject = decodeHeader(msg.Header.Get("Subject"))
+	m.MessageID = strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>")
+	if msg.Header.Get("Date") != "" {
+		date, err := msg.Header.Date()
+		if err == nil {
+			m.Date = date
+		}
+	}
+	m.Root, err = parsePart(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return &m, nil
+}
+
+// decode RFC 2047 encoded words, leaving the value as-is if it is malformed
+func decodeHeader(value string) string {
+	decoder := mime.WordDecoder{}
+	decoded, err := decoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func parsePart(header textproto.MIMEHeader, body io.Reader, depth int) (*MessagePart, error) {
+	if depth > MAX_MIME_DEPTH {
+		return nil, Fatalf("MIME nesting exceeds %d levels", MAX_MIME_DEPTH)
+	}
+	part := MessagePart{
+		Header:      header,
+		ContentType: "text/plain",
+		Params:      map[string]string{},
+		ContentID:   strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>"),
+	}
+	if value := header.Get("Content-Type"); value != "" {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err == nil {
+			part.ContentType = mediaType
+			part.Params = params
+		}
+	}
+	if value := header.Get("Content-Disposition"); value != "" {
+		disposition, params, err := mime.ParseMediaType(value)
+		if err == nil {
+			part.Disposition = disposition
+			part.Filename = decodeHeader(params["filename"])
+		}
+	}
+	if part.Filename == "" && part.Params["name"] != "" {
+		part.Filename = decodeHeader(part.Params["name"])
+	}
+
+	if strings.HasPrefix(part.ContentType, "multipart/") {
+		boundary := part.Params["boundary"]
+		if boundary == "" {
+			return nil, Fatalf("%s part has no boundary", part.ContentType)
+		}
+		reader := multipart.NewReader(body, boundary)
+		for {
+			// NextRawPart leaves the transfer encoding for decodePart
+			child, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, Fatal(err)
+			}
+			parsed, err := parsePart(child.Header, child, depth+1)
+			if err != nil {
+				return nil, Fatal(err)
+			}
+			part.Parts = append(part.Parts, parsed)
+		}
+		return &part, nil
+	}
+
+	data, err := decodePart(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	part.Body = data
+	return &part, nil
+}
+
+func decodePart(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &base64Filter{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, Fatalf("failed decoding %s part: %v", encoding, err)
+	}
+	return data, nil
+}
+
+// base64Filter drops the whitespace the standard decoder does not skip
+type base64Filter struct {
+	r io.Reader
+}
+
+func (f *base64Filter) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		j := 0
+		for _, c := range p[:n] {
+			if c != ' ' && c != '\t' {
+				p[j] = c
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// Walk calls fn for every part in depth-first order
+func (m *ParsedMessage) Walk(fn func(part *MessagePart) error) error {
+	return m.Root.walk(fn)
+}
+
+func (p *MessagePart) walk(fn func(part *MessagePart) error) error {
+	err := fn(p)
+	if err != nil {
+		return err
+	}
+	for _, child := range p.Parts {
+		err = child.walk(fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsAttachment reports parts with an attachment disposition, or a
+// filename on a part that is not inline
+func (p *MessagePart) IsAttachment() bool {
+	if strings.EqualFold(p.Disposition, "attachment") {
+		return true
+	}
+	return p.Filename != "" && !strings.EqualFold(p.Disposition, "inline")
+}
+
+// Text returns the first plain text body that is not an attachment, with
+// LF line endings
+func (m *ParsedMessage) Text() string {
+	return m.findBody("text/plain")
+}
+
+// HTML returns the first HTML body that is not an attachment, with LF line
+// endings
+func (m *ParsedMessage) HTML() string {
+	return m.findBody("text/html")
+}
+
+func (m *ParsedMessage) findBody(contentType string) string {
+	body := ""
+	m.Walk(func(part *MessagePart) error {
+		if part.ContentType == contentType && !part.IsAttachment() {
+			body = string(toLF(part.Body))
+			return io.EOF
+		}
+		return nil
+	})
+	return body
+}
+
+// Attachments returns the attachment and inline parts that carry a
+// filename or Content-ID, in the form Message uses for outgoing mail
+func (m *ParsedMessage) Attachments() []*Attachment {
+	attachments := []*Attachment{}
+	m.Walk(func(part *MessagePart) error {
+		if part.Parts != nil || (!part.IsAttachment() && part.ContentID == "") {
+			return nil
+		}
+		attachments = append(attachments, &Attachment{
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			ContentID:   part.ContentID,
+			Data:        part.Body,
+		})
+		return nil
+	})
+	return attachments
+}
+
+// FromDomain returns the domain of the first From address, or empty when
+// there is none
+func (m *ParsedMessage) FromDomain() string {
+	if len(m.From) == 0 {
+		return ""
+	}
+	return extractDomain(m.From[0].String())
+}
+
+// IsBounce reports a multipart/report delivery status notification
+func (m *ParsedMessage) IsBounce() bool {
+	return m.Root.ContentType == "multipart/report" && strings.EqualFold(m.Root.Params["report-type"], "delivery-status")
+}
+
+// DeliveryStatus parses the message/delivery-status part of a bounce,
+// returning the per-recipient sections
+func (m *ParsedMessage) DeliveryStatus() ([]*DSNRecipient, error) {
+	var status *MessagePart
+	m.Walk(func(part *MessagePart) error {
+		if part.ContentType == "message/delivery-status" || part.ContentType == "message/global-delivery-status" {
+			status = part
+			return io.EOF
+		}
+		return nil
+	})
+	if status == nil {
+		return nil, Fatalf("message has no delivery-status part")
+	}
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(status.Body)))
+	// the first block describes the message, the rest one recipient each
+	_, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, Fatal(err)
+	}
+	recipients := []*DSNRecipient{}
+	for err == nil {
+		var fields textproto.MIMEHeader
+		fields, err = reader.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, Fatal(err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		recipients = append(recipients, &DSNRecipient{
+			FinalRecipient:    dsnValue(fields.Get("Final-Recipient")),
+			OriginalRecipient: dsnValue(fields.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:            strings.TrimSpace(fields.Get("Status")),
+			DiagnosticCode:    dsnValue(fields.Get("Diagnostic-Code")),
+			RemoteMTA:         dsnValue(fields.Get("Remote-MTA")),
+		})
+	}
+	return recipients, nil
+}
+
+// FailedRecipients returns the recipients a bounce reports as failed
+func (m *ParsedMessage) FailedRecipients() ([]string, error) {
+	if !m.IsBounce() {
+		return nil, Fatalf("message is not a delivery status notification")
+	}
+	recipients, err := m.DeliveryStatus()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	failed := []string{}
+	for _, recipient := range recipients {
+		if recipient.Action == "failed" {
+			failed = append(failed, recipient.FinalRecipient)
+		}
+	}
+	return failed, nil
+}
+
+// strip the type prefix from a DSN field such as "rfc822; user@example.com"
+func dsnValue(value string) string {
+	_, address, found := strings.Cut(value, ";")
+	if !found {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(address)
+}
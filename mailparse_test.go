@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "report.csv")
+	require.Nil(t, os.WriteFile(csvFile, []byte("a,b\n1,2\n"), 0600))
+	imageFile := filepath.Join(dir, "logo.png")
+	require.Nil(t, os.WriteFile(imageFile, []byte("\x89PNG\r\n\x1a\nnot really"), 0600))
+
+	msg := Message{
+		From:    "Jörg Müller <joerg@example.com>",
+		To:      []string{"rcpt@example.com, Zoë <zoe@example.com>"},
+		Cc:      []string{"copy@example.com"},
+		Subject: "Grüße aus Köln",
+		Body:    []byte("plain text ünïcode\n"),
+	}
+	cid, err := msg.Embed(imageFile)
+	require.Nil(t, err)
+	msg.HTML = []byte(`<p>html</p><img src="cid:` + cid + `">`)
+	require.Nil(t, msg.Attach(csvFile))
+	data, err := formatMessage(&msg, "")
+	require.Nil(t, err)
+
+	parsed, err := ParseMessage(bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Equal(t, "Grüße aus Köln", parsed.Subject)
+	require.Len(t, parsed.From, 1)
+	require.Equal(t, "Jörg Müller", parsed.From[0].Name)
+	require.Equal(t, "example.com", parsed.FromDomain())
+	require.Len(t, parsed.To, 2)
+	require.Equal(t, "Zoë", parsed.To[1].Name)
+	require.Equal(t, "copy@example.com", parsed.Cc[0].Address)
+	require.NotEmpty(t, parsed.MessageID)
+	require.False(t, parsed.Date.IsZero())
+	require.Equal(t, "multipart/mixed", parsed.Root.ContentType)
+	require.Equal(t, "plain text ünïcode\n", parsed.Text())
+	require.Contains(t, parsed.HTML(), "cid:"+cid)
+	require.False(t, parsed.IsBounce())
+
+	attachments := parsed.Attachments()
+	require.Len(t, attachments, 2)
+	require.Equal(t, cid, attachments[0].ContentID)
+	require.Equal(t, []byte("\x89PNG\r\n\x1a\nnot really"), attachments[0].Data)
+	require.Equal(t, "report.csv", attachments[1].Filename)
+	require.Equal(t, []byte("a,b\n1,2\n"), attachments[1].Data)
+}
+
+func TestParseBounce(t *testing.T) {
+	bounce := strings.ReplaceAll(`From: Mail Delivery System <MAILER-DAEMON@mx.example.com>
+To: sender@example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="XXBOUNDARY"
+
+--XXBOUNDARY
+Content-Type: text/plain; charset=us-ascii
+
+I'm sorry to have to inform you that your message could not be delivered.
+
+--XXBOUNDARY
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+Arrival-Date: Mon, 19 Oct 2026 08:00:00 +0000
+
+Final-Recipient: rfc822; unknown@example.com
+Original-Recipient: rfc822;unknown@example.com
+Action: failed
+Status: 5.1.1
+Remote-MTA: dns; mail.example.net
+Diagnostic-Code: smtp; 550 5.1.1 mailbox unknown
+
+Final-Recipient: rfc822; slow@example.com
+Action: delayed
+Status: 4.4.1
+
+--XXBOUNDARY
+Content-Type: text/rfc822-headers
+
+Subject: report
+--XXBOUNDARY--
+`, "\n", "\r\n")
+
+	parsed, err := ParseMessage(strings.NewReader(bounce))
+	require.Nil(t, err)
+	require.True(t, parsed.IsBounce())
+	recipients, err := parsed.DeliveryStatus()
+	require.Nil(t, err)
+	require.Len(t, recipients, 2)
+	require.Equal(t, "unknown@example.com", recipients[0].OriginalRecipient)
+	require.Equal(t, "5.1.1", recipients[0].Status)
+	require.Equal(t, "550 5.1.1 mailbox unknown", recipients[0].DiagnosticCode)
+	require.Equal(t, "mail.example.net", recipients[0].RemoteMTA)
+	require.Equal(t, "delayed", recipients[1].Action)
+	failed, err := parsed.FailedRecipients()
+	require.Nil(t, err)
+	require.Equal(t, []string{"unknown@example.com"}, failed)
+}
+
+func TestParseMalformedHeaders(t *testing.T) {
+	raw := "From: Postmaster <postmaster@example.com>\r\n" +
+		"To: rcpt@example.com\r\n" +
+		"Cc: undisclosed-recipients:;, <<broken\r\n" +
+		"Date: sometime last tuesday\r\n" +
+		"Subject: Re: status\r\n" +
+		"\r\n" +
+		"reply body\r\n"
+	parsed, err := ParseMessage(strings.NewReader(raw))
+	require.Nil(t, err)
+	require.Equal(t, "postmaster@example.com", parsed.From[0].Address)
+	require.Equal(t, "rcpt@example.com", parsed.To[0].Address)
+	require.Empty(t, parsed.Cc)
+	require.True(t, parsed.Date.IsZero())
+	require.Equal(t, "sometime last tuesday", parsed.Header.Get("Date"))
+	require.Equal(t, "Re: status", parsed.Subject)
+	require.Equal(t, "reply body\n", parsed.Text())
+}
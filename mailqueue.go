@@ -0,0 +1,438 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_MAIL_QUEUE_DIR = "mailqueue"
+const DEFAULT_MAIL_QUEUE_MIN_DELAY = 60
+const DEFAULT_MAIL_QUEUE_MAX_DELAY = 3600
+const DEFAULT_MAIL_QUEUE_MAX_AGE = 5 * 24 * 3600
+const DEFAULT_MAIL_QUEUE_CLAIM_TIMEOUT = 3600
+
+const MAIL_QUEUE_ACTIVE = "active"
+const MAIL_QUEUE_DEAD = "dead"
+
+// QueuedMessage is one spooled message and its delivery state.  After a
+// partial delivery Recipients holds the envelope recipients still pending;
+// the message and its headers are sent unchanged.
+type QueuedMessage struct {
+	ID          string    `json:"id"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Recipients  []string  `json:"recipients,omitempty"`
+	Message     *Message  `json:"message"`
+}
+
+// MailQueue spools messages on disk and hands them to a Sendmail
+// transport, retrying temporary failures with exponential backoff.  Each
+// message is a JSON file in the active dir; messages that fail
+// permanently or exceed MaxAge are moved to the dead dir.  LocalName is the
+// domain of the Message-IDs assigned by Enqueue, taken from the sender's
+// smtp.local_name setting.
+type MailQueue struct {
+	Dir          string
+	Sender       Sendmail
+	MinDelay     time.Duration
+	MaxDelay     time.Duration
+	MaxAge       time.Duration
+	ClaimTimeout time.Duration
+	Verbose      bool
+	LocalName    string
+}
+
+// NewMailQueue opens or creates a spool in dir; an empty dir selects
+// mailqueue under the cache dir
+func NewMailQueue(dir string, sender Sendmail) (*MailQueue, error) {
+	if dir == "" {
+		cache, err := cacheDir()
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		dir = filepath.Join(cache, DEFAULT_MAIL_QUEUE_DIR)
+	}
+	q := MailQueue{
+		Dir:          dir,
+		Sender:       sender,
+		MinDelay:     DEFAULT_MAIL_QUEUE_MIN_DELAY * time.Second,
+		MaxDelay:     DEFAULT_MAIL_QUEUE_MAX_DELAY * time.Second,
+		MaxAge:       DEFAULT_MAIL_QUEUE_MAX_AGE * time.Second,
+		ClaimTimeout: DEFAULT_MAIL_QUEUE_CLAIM_TIMEOUT * time.Second,
+	}
+	if transport, ok := sender.(sendmailTransport); ok {
+		q.LocalName = transport.identity()
+	}
+	for _, sub := range []string{MAIL_QUEUE_ACTIVE, MAIL_QUEUE_DEAD} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	return &q, nil
+}
+
+// NewMailQueueFromConfig reads the smtp.queue section and delivers
+// through the transport selected by the smtp section
+func NewMailQueueFromConfig(prefix string) (*MailQueue, error) {
+	ViperSetDefault(prefix+"smtp.queue.min_delay", DEFAULT_MAIL_QUEUE_MIN_DELAY)
+	ViperSetDefault(prefix+"smtp.queue.max_delay", DEFAULT_MAIL_QUEUE_MAX_DELAY)
+	ViperSetDefault(prefix+"smtp.queue.max_age", DEFAULT_MAIL_QUEUE_MAX_AGE)
+	sender, err := NewSendmailFromConfig(prefix)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	q, err := NewMailQueue(ViperGetString(prefix+"smtp.queue.dir"), sender)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	q.MinDelay = time.Duration(ViperGetInt64(prefix+"smtp.queue.min_delay")) * time.Second
+	q.MaxDelay = time.Duration(ViperGetInt64(prefix+"smtp.queue.max_delay")) * time.Second
+	q.MaxAge = time.Duration(ViperGetInt64(prefix+"smtp.queue.max_age")) * time.Second
+	q.Verbose = ViperGetBool(prefix + "verbose")
+	return q, nil
+}
+
+// Enqueue validates and spools a message, returning its queue ID.  The
+// Message-ID and Date are fixed here so every attempt sends the same
+// message.
+func (q *MailQueue) Enqueue(msg *Message) (string, error) {
+	_, _, _, err := prepareMessage(msg, q.LocalName)
+	if err != nil {
+		return "", Fatal(err)
+	}
+	queued := *msg
+	if queued.MessageID == "" {
+		queued.MessageID = generateMessageID(q.LocalName, queued.From)
+	}
+	if queued.Date.IsZero() {
+		queued.Date = time.Now()
+	}
+	now := time.Now()
+	entry := QueuedMessage{
+		ID:          now.UTC().Format("20060102T150405.000000000") + "-" + uuid.New().String(),
+		Created:     now,
+		NextAttempt: now,
+		Message:     &queued,
+	}
+	err = q.write(MAIL_QUEUE_ACTIVE, &entry)
+	if err != nil {
+		return "", Fatal(err)
+	}
+	return entry.ID, nil
+}
+
+// List returns the messages in the active queue, or the dead letters,
+// oldest first
+func (q *MailQueue) List(dead bool) ([]*QueuedMessage, error) {
+	dir := filepath.Join(q.Dir, queueSubdir(dead))
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	entries := []*QueuedMessage{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".sending") {
+			continue
+		}
+		entry, err := q.read(filepath.Join(dir, name))
+		if err != nil {
+			Warning("skipping unreadable queue file %s: %v", name, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// Purge removes every message from the active queue, or the dead
+// letters, returning the number removed
+func (q *MailQueue) Purge(dead bool) (int, error) {
+	dir := filepath.Join(q.Dir, queueSubdir(dead))
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, Fatal(err)
+	}
+	count := 0
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".sending") {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return count, Fatal(err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Flush attempts delivery of every message whose retry time has come,
+// or of all messages when force is set.  It returns the number
+// delivered; delivery failures are recorded in the queue, not returned.
+func (q *MailQueue) Flush(force bool) (int, error) {
+	dir := filepath.Join(q.Dir, MAIL_QUEUE_ACTIVE)
+	q.reclaim(dir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, Fatal(err)
+	}
+	sent := 0
+	now := time.Now()
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		entry, err := q.read(filename)
+		if err != nil {
+			Warning("skipping unreadable queue file %s: %v", name, err)
+			continue
+		}
+		if !force && entry.NextAttempt.After(now) {
+			continue
+		}
+		// claim the file so a concurrent flush does not send it twice
+		claimed := strings.TrimSuffix(filename, ".json") + ".sending"
+		err = os.Rename(filename, claimed)
+		if err != nil {
+			continue
+		}
+		ok, err := q.deliver(entry)
+		if err != nil {
+			return sent, Fatal(err)
+		}
+		err = os.Remove(claimed)
+		if err != nil {
+			return sent, Fatal(err)
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// Run flushes the queue every interval until the context is cancelled
+func (q *MailQueue) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := q.Flush(false)
+		if err != nil {
+			Warning("mail queue flush failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// attempt one delivery and write the entry back to the active or dead
+// dir; the returned bool reports a successful send
+func (q *MailQueue) deliver(entry *QueuedMessage) (bool, error) {
+	entry.Attempts++
+	msg := entry.Message
+	if len(entry.Recipients) > 0 {
+		pending := *entry.Message
+		pending.envelope = entry.Recipients
+		msg = &pending
+	}
+	err := q.Sender.SendMessage(msg)
+	if err == nil {
+		if q.Verbose {
+			log.Printf("mail queue: sent %s after %d attempts\n", entry.ID, entry.Attempts)
+		}
+		return true, nil
+	}
+
+	var rcptErr *RecipientError
+	if errors.As(err, &rcptErr) {
+		return q.deliverPartial(entry, rcptErr)
+	}
+	return false, q.retryLater(entry, err)
+}
+
+// split a recipient failure: accepted recipients are done, permanently
+// rejected ones become a dead letter, and temporarily rejected ones stay
+// queued, each entry holding only its own envelope recipients
+func (q *MailQueue) deliverPartial(entry *QueuedMessage, rcptErr *RecipientError) (bool, error) {
+	permanent := &RecipientError{Rejected: make(map[string]error)}
+	temporary := &RecipientError{Rejected: make(map[string]error)}
+	for addr, rejected := range rcptErr.Rejected {
+		if isPermanentMailError(rejected) {
+			permanent.Rejected[addr] = rejected
+		} else {
+			temporary.Rejected[addr] = rejected
+		}
+	}
+	if len(permanent.Rejected) > 0 {
+		recipients, err := pendingRecipients(entry, permanent.Rejected)
+		if err != nil {
+			return false, Fatal(err)
+		}
+		// the remainder may still fail permanently under the entry's own ID
+		dead := *entry
+		dead.ID = fmt.Sprintf("%s-%d", entry.ID, entry.Attempts)
+		dead.Recipients = recipients
+		dead.LastError = permanent.Error()
+		Warning("mail queue: %s failed permanently: %v", entry.ID, permanent)
+		err = q.write(MAIL_QUEUE_DEAD, &dead)
+		if err != nil {
+			return false, Fatal(err)
+		}
+	}
+	if len(temporary.Rejected) > 0 {
+		recipients, err := pendingRecipients(entry, temporary.Rejected)
+		if err != nil {
+			return false, Fatal(err)
+		}
+		entry.Recipients = recipients
+		err = q.retryLater(entry, temporary)
+		if err != nil {
+			return false, Fatal(err)
+		}
+	}
+	delivered := len(rcptErr.Accepted) > 0
+	if delivered && q.Verbose {
+		log.Printf("mail queue: sent %s to %s\n", entry.ID, strings.Join(rcptErr.Accepted, ", "))
+	}
+	return delivered, nil
+}
+
+// write the entry back to the active dir with its next attempt time, or
+// to the dead dir when err is permanent or the entry has expired
+func (q *MailQueue) retryLater(entry *QueuedMessage, err error) error {
+	entry.LastError = err.Error()
+	if isPermanentMailError(err) {
+		Warning("mail queue: %s failed permanently: %v", entry.ID, err)
+		return q.write(MAIL_QUEUE_DEAD, entry)
+	}
+	if q.MaxAge > 0 && time.Since(entry.Created) > q.MaxAge {
+		Warning("mail queue: %s expired after %d attempts: %v", entry.ID, entry.Attempts, err)
+		return q.write(MAIL_QUEUE_DEAD, entry)
+	}
+	entry.NextAttempt = time.Now().Add(q.backoff(entry.Attempts))
+	if q.Verbose {
+		log.Printf("mail queue: %s deferred until %s: %v\n", entry.ID, entry.NextAttempt.Format(time.RFC3339), err)
+	}
+	return q.write(MAIL_QUEUE_ACTIVE, entry)
+}
+
+// the entry's envelope recipients that are in addrs, in sending order
+func pendingRecipients(entry *QueuedMessage, addrs map[string]error) ([]string, error) {
+	recipients := entry.Recipients
+	if len(recipients) == 0 {
+		var err error
+		recipients, err = entry.Message.Recipients()
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	pending := []string{}
+	for _, addr := range recipients {
+		if _, ok := addrs[addr]; ok {
+			pending = append(pending, addr)
+		}
+	}
+	return pending, nil
+}
+
+func (q *MailQueue) backoff(attempts int) time.Duration {
+	delay := q.MinDelay
+	for i := 1; i < attempts && delay < q.MaxDelay; i++ {
+		delay *= 2
+	}
+	if q.MaxDelay > 0 && delay > q.MaxDelay {
+		delay = q.MaxDelay
+	}
+	return delay
+}
+
+// return claims abandoned by a flush that crashed to the queue
+func (q *MailQueue) reclaim(dir string) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".sending") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || time.Since(info.ModTime()) < q.ClaimTimeout {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		os.Rename(filename, strings.TrimSuffix(filename, ".sending")+".json")
+	}
+}
+
+func (q *MailQueue) read(filename string) (*QueuedMessage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	var entry QueuedMessage
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, Fatalf("failed decoding queue file %s: %v", filename, err)
+	}
+	return &entry, nil
+}
+
+func (q *MailQueue) write(subdir string, entry *QueuedMessage) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return Fatal(err)
+	}
+	err = writeFileAtomic(filepath.Join(q.Dir, subdir, entry.ID+".json"), data, 0600)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+func queueSubdir(dead bool) string {
+	if dead {
+		return MAIL_QUEUE_DEAD
+	}
+	return MAIL_QUEUE_ACTIVE
+}
+
+// a 5xx reply to MAIL, RCPT, or DATA is permanent; anything else,
+// including connection, STARTTLS, and AUTH failures, is worth retrying
+func isPermanentMailError(err error) bool {
+	var rcptErr *RecipientError
+	if errors.As(err, &rcptErr) {
+		for _, rejected := range rcptErr.Rejected {
+			if !isPermanentMailError(rejected) {
+				return false
+			}
+		}
+		return len(rcptErr.Rejected) > 0
+	}
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.IsPermanentForMessage()
+	}
+	return false
+}
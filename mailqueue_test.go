@@ -0,0 +1,207 @@
+package common
+
+import (
+	"github.com/rstms/go-common/smtptest"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailQueue(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	server.FailCount(smtptest.STAGE_MAIL, 451, "4.3.0 try again later", 1)
+	server.FailRecipient("unknown@example.com", 550, "5.1.1 mailbox unknown")
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+
+	q, err := NewMailQueue(t.TempDir(), s)
+	require.Nil(t, err)
+
+	id, err := q.Enqueue(&Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "queued",
+		Body:    []byte("howdy\n"),
+	})
+	require.Nil(t, err)
+	_, err = q.Enqueue(&Message{
+		From:    "sender@example.com",
+		To:      []string{"unknown@example.com"},
+		Subject: "undeliverable",
+		Body:    []byte("howdy\n"),
+	})
+	require.Nil(t, err)
+
+	entries, err := q.List(false)
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+	messageID := entries[0].Message.MessageID
+	require.NotEmpty(t, messageID)
+
+	// the first message is deferred, the second is rejected permanently
+	sent, err := q.Flush(false)
+	require.Nil(t, err)
+	require.Equal(t, 0, sent)
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, id, entries[0].ID)
+	require.Equal(t, 1, entries[0].Attempts)
+	require.True(t, entries[0].NextAttempt.After(time.Now()))
+	dead, err := q.List(true)
+	require.Nil(t, err)
+	require.Len(t, dead, 1)
+	require.Contains(t, dead[0].LastError, "550")
+
+	// not due yet
+	sent, err = q.Flush(false)
+	require.Nil(t, err)
+	require.Equal(t, 0, sent)
+
+	sent, err = q.Flush(true)
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	require.True(t, strings.Contains(string(messages[0].Data), "Message-ID: <"+messageID+">\r\n"))
+
+	// a claim left by a crashed flush is purged with the rest
+	_, err = q.Enqueue(&Message{From: "sender@example.com", To: []string{"rcpt@example.com"}, Body: []byte("howdy\n")})
+	require.Nil(t, err)
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	claimed := filepath.Join(q.Dir, MAIL_QUEUE_ACTIVE, entries[0].ID)
+	require.Nil(t, os.Rename(claimed+".json", claimed+".sending"))
+	count, err := q.Purge(false)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	count, err = q.Purge(true)
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	dead, err = q.List(true)
+	require.Nil(t, err)
+	require.Empty(t, dead)
+}
+
+func TestMailQueuePartialDelivery(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	server.FailRecipient("later@example.com", 451, "4.2.2 mailbox full")
+	server.FailRecipient("gone@example.com", 550, "5.1.1 mailbox unknown")
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+	q, err := NewMailQueue(t.TempDir(), s)
+	require.Nil(t, err)
+
+	id, err := q.Enqueue(&Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com", "Later <later@example.com>"},
+		Cc:      []string{"gone@example.com"},
+		Subject: "partial",
+		Body:    []byte("howdy\n"),
+	})
+	require.Nil(t, err)
+
+	sent, err := q.Flush(false)
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	require.Equal(t, []string{"rcpt@example.com"}, messages[0].Recipients)
+
+	// the temporary failure is retried for its recipient only, with the
+	// original headers
+	entries, err := q.List(false)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, id, entries[0].ID)
+	require.Equal(t, []string{"later@example.com"}, entries[0].Recipients)
+	require.Equal(t, []string{"rcpt@example.com", "Later <later@example.com>"}, entries[0].Message.To)
+	require.Equal(t, []string{"gone@example.com"}, entries[0].Message.Cc)
+	require.Contains(t, entries[0].LastError, "451")
+	require.True(t, entries[0].NextAttempt.After(time.Now()))
+
+	// the permanent failure is a dead letter for its recipient only
+	dead, err := q.List(true)
+	require.Nil(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, []string{"gone@example.com"}, dead[0].Recipients)
+	require.Equal(t, []string{"gone@example.com"}, dead[0].Message.Cc)
+	require.Contains(t, dead[0].LastError, "550")
+
+	sent, err = q.Flush(true)
+	require.Nil(t, err)
+	require.Equal(t, 0, sent)
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, 2, entries[0].Attempts)
+	require.Len(t, server.Messages(), 1)
+
+	// a later permanent failure does not replace the first dead letter
+	server.FailRecipient("later@example.com", 550, "5.2.1 mailbox disabled")
+	sent, err = q.Flush(true)
+	require.Nil(t, err)
+	require.Equal(t, 0, sent)
+	dead, err = q.List(true)
+	require.Nil(t, err)
+	require.Len(t, dead, 2)
+	require.Equal(t, id+"-1", dead[0].ID)
+	require.Contains(t, dead[0].LastError, "5.1.1")
+	require.Equal(t, id+"-3", dead[1].ID)
+	require.Contains(t, dead[1].LastError, "5.2.1")
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	// the retry goes to the pending recipient with the original headers
+	server.Reset()
+	server.FailRecipient("later@example.com", 451, "4.2.2 mailbox full")
+	_, err = q.Enqueue(&Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com", "later@example.com"},
+		Subject: "retried",
+		Body:    []byte("howdy\n"),
+	})
+	require.Nil(t, err)
+	sent, err = q.Flush(false)
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+	server.Reset()
+	sent, err = q.Flush(true)
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+	messages = server.Messages()
+	require.Len(t, messages, 1)
+	require.Equal(t, []string{"later@example.com"}, messages[0].Recipients)
+	require.Contains(t, string(messages[0].Data), "To: rcpt@example.com, later@example.com\r\n")
+	entries, err = q.List(false)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMailQueueBackoff(t *testing.T) {
+	q := MailQueue{MinDelay: time.Minute, MaxDelay: time.Hour}
+	require.Equal(t, time.Minute, q.backoff(1))
+	require.Equal(t, 2*time.Minute, q.backoff(2))
+	require.Equal(t, 32*time.Minute, q.backoff(6))
+	require.Equal(t, time.Hour, q.backoff(7))
+	require.Equal(t, time.Hour, q.backoff(20))
+}
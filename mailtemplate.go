@@ -0,0 +1,146 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+const DEFAULT_MAIL_TEMPLATE_DIR = "templates"
+
+// MailTemplate renders a message from up to three files sharing a base
+// name: NAME.subject and NAME.txt are text/template sources, NAME.html is
+// an html/template source.  At least one of the bodies must exist.
+type MailTemplate struct {
+	Name    string
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// NewMailTemplate loads the named template from fsys, which may be an
+// embed.FS or os.DirFS
+func NewMailTemplate(fsys fs.FS, name string) (*MailTemplate, error) {
+	t := MailTemplate{Name: name}
+	source, err := readTemplateFile(fsys, name+".subject")
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if source != "" {
+		t.subject, err = texttemplate.New(name + ".subject").Option("missingkey=error").Parse(source)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	source, err = readTemplateFile(fsys, name+".txt")
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if source != "" {
+		t.text, err = texttemplate.New(name + ".txt").Option("missingkey=error").Parse(source)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	source, err = readTemplateFile(fsys, name+".html")
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if source != "" {
+		t.html, err = htmltemplate.New(name + ".html").Option("missingkey=error").Parse(source)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	if t.text == nil && t.html == nil {
+		return nil, Fatalf("mail template '%s' has no .txt or .html body", name)
+	}
+	return &t, nil
+}
+
+// NewMailTemplateFromConfig loads the named template from the
+// smtp.template_dir config value, defaulting to templates under ConfigDir()
+func NewMailTemplateFromConfig(prefix, name string) (*MailTemplate, error) {
+	dir := ViperGetString(prefix + "smtp.template_dir")
+	if dir == "" {
+		dir = filepath.Join(ConfigDir(), DEFAULT_MAIL_TEMPLATE_DIR)
+	}
+	t, err := NewMailTemplate(os.DirFS(dir), name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return t, nil
+}
+
+// a missing file is not an error, it yields an empty source
+func readTemplateFile(fsys fs.FS, filename string) (string, error) {
+	data, err := fs.ReadFile(fsys, filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", Fatal(err)
+	}
+	return string(data), nil
+}
+
+// Render executes the templates with data, returning a message with the
+// Subject, Body, and HTML set; the caller adds the addresses
+func (t *MailTemplate) Render(data interface{}) (*Message, error) {
+	msg := Message{}
+	if t.subject != nil {
+		var buf bytes.Buffer
+		err := t.subject.Execute(&buf, data)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		msg.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	}
+	if t.text != nil {
+		var buf bytes.Buffer
+		err := t.text.Execute(&buf, data)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		msg.Body = buf.Bytes()
+	}
+	if t.html != nil {
+		var buf bytes.Buffer
+		err := t.html.Execute(&buf, data)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		msg.HTML = buf.Bytes()
+	}
+	return &msg, nil
+}
+
+// Preview renders the templates with data and writes the subject and
+// bodies to w in readable form
+func (t *MailTemplate) Preview(w io.Writer, data interface{}) error {
+	msg, err := t.Render(data)
+	if err != nil {
+		return Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Subject: " + msg.Subject + "\n")
+	if msg.Body != nil {
+		buf.WriteString("\n--- text/plain ---\n")
+		buf.Write(msg.Body)
+	}
+	if msg.HTML != nil {
+		buf.WriteString("\n--- text/html ---\n")
+		buf.Write(msg.HTML)
+	}
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMailTemplate(t *testing.T) {
+	initTestConfig(t)
+	tmpl, err := NewMailTemplateFromConfig("", "alert")
+	require.Nil(t, err)
+
+	data := map[string]interface{}{"Host": "db1", "Job": "<backup>", "Status": 2}
+	msg, err := tmpl.Render(data)
+	require.Nil(t, err)
+	require.Equal(t, "[db1] <backup> failed", msg.Subject)
+	require.Equal(t, "Job <backup> on db1 exited with status 2.\n", string(msg.Body))
+	require.Equal(t, "<p>Job <b>&lt;backup&gt;</b> on db1 exited with status 2.</p>\n", string(msg.HTML))
+
+	msg.From = "sender@example.com"
+	msg.To = []string{"rcpt@example.com"}
+	_, _, formatted, err := prepareMessage(msg, "")
+	require.Nil(t, err)
+	require.Contains(t, string(formatted), "multipart/alternative")
+
+	var buf bytes.Buffer
+	err = tmpl.Preview(&buf, data)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(buf.String(), "Subject: [db1] <backup> failed\n"))
+	require.Contains(t, buf.String(), "--- text/html ---")
+
+	_, err = tmpl.Render(map[string]interface{}{"Host": "db1"})
+	require.NotNil(t, err)
+
+	_, err = NewMailTemplateFromConfig("", "missing")
+	require.NotNil(t, err)
+}
+
+func TestMailTemplateFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"notice.txt": &fstest.MapFile{Data: []byte("hello {{.}}\n")},
+	}
+	tmpl, err := NewMailTemplate(fsys, "notice")
+	require.Nil(t, err)
+	msg, err := tmpl.Render("world")
+	require.Nil(t, err)
+	require.Equal(t, "", msg.Subject)
+	require.Equal(t, "hello world\n", string(msg.Body))
+	require.Nil(t, msg.HTML)
+}
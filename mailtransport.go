@@ -0,0 +1,281 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// values for the smtp.transport config key
+const SMTP_TRANSPORT_SMTP = "smtp"
+const SMTP_TRANSPORT_SENDMAIL = "sendmail"
+const SMTP_TRANSPORT_FILE = "file"
+const SMTP_TRANSPORT_MAILDIR = "maildir"
+
+const DEFAULT_SENDMAIL_PATH = "/usr/sbin/sendmail"
+
+// SendmailCommand hands each message to the local sendmail binary
+type SendmailCommand struct {
+	sendmailOptions
+	Path string
+}
+
+// SendmailFile writes each message to a directory as a .eml file
+type SendmailFile struct {
+	sendmailOptions
+	Dir string
+}
+
+// SendmailMaildir delivers each message to a Maildir
+type SendmailMaildir struct {
+	sendmailOptions
+	Dir string
+}
+
+func NewSendmailCommand(path string) (Sendmail, error) {
+	if path == "" {
+		path = DEFAULT_SENDMAIL_PATH
+	}
+	if !IsFile(path) {
+		return nil, Fatalf("sendmail binary not found: %s", path)
+	}
+	return &SendmailCommand{Path: path}, nil
+}
+
+func NewSendmailFile(dir string) (Sendmail, error) {
+	if dir == "" {
+		return nil, Fatalf("file transport requires smtp.file_dir")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return &SendmailFile{Dir: dir}, nil
+}
+
+func NewSendmailMaildir(dir string) (Sendmail, error) {
+	if dir == "" {
+		return nil, Fatalf("maildir transport requires smtp.maildir")
+	}
+	for _, subdir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, subdir), 0700)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	return &SendmailMaildir{Dir: dir}, nil
+}
+
+func (s *SendmailCommand) Send(to, from, subject string, body []byte) error {
+	return s.SendMessage(newMessage(to, from, subject, body))
+}
+
+// the message is sent with sendmail -t -i, which reads the recipients from
+// the To, Cc, and Bcc headers and removes Bcc; DSN options map to -N, -R,
+// and -V
+func (s *SendmailCommand) SendMessage(msg *Message) error {
+	return s.SendContext(context.Background(), msg)
+}
+
+// the sendmail process is killed if ctx ends before it exits
+func (s *SendmailCommand) SendContext(ctx context.Context, msg *Message) error {
+	from, _, data, err := s.prepare(msg)
+	if err != nil {
+		return Fatal(err)
+	}
+	dsn, err := s.dsnOptions(msg)
+	if err != nil {
+		return Fatal(err)
+	}
+	bcc, err := parseAddressList("Bcc", msg.Bcc)
+	if err != nil {
+		return Fatal(err)
+	}
+	if len(bcc) > 0 {
+		data = append([]byte(fmt.Sprintf("Bcc: %s\r\n", formatAddressList(bcc))), data...)
+	}
+	return s.deliver(ctx, from, nil, data, dsn)
+}
+
+// a raw message keeps its given envelope, so the recipients are passed on
+// the command line instead of read from the headers
+func (s *SendmailCommand) SendRaw(envelopeFrom string, recipients []string, r io.Reader) error {
+	r, err := s.prepareRaw(envelopeFrom, recipients, r)
+	if err != nil {
+		return Fatal(err)
+	}
+	// the local transports need the whole message in memory
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Fatal(err)
+	}
+	return s.deliver(context.Background(), envelopeFrom, recipients, data, s.DSN)
+}
+
+// run sendmail with -t when recipients is empty
+func (s *SendmailCommand) deliver(ctx context.Context, from string, recipients []string, data []byte, dsn *DSNOptions) error {
+	if from == "" {
+		from = "<>"
+	}
+	args := []string{"-i", "-f", from}
+	if len(recipients) == 0 {
+		args = append([]string{"-t"}, args...)
+	}
+	if dsn != nil {
+		if len(dsn.Notify) > 0 {
+			args = append(args, "-N", strings.ToLower(strings.Join(dsn.Notify, ",")))
+		}
+		if dsn.Return != "" {
+			args = append(args, "-R", strings.ToLower(dsn.Return))
+		}
+		if dsn.EnvelopeID != "" {
+			args = append(args, "-V", dsn.EnvelopeID)
+		}
+	}
+	if len(recipients) > 0 {
+		args = append(append(args, "--"), recipients...)
+	}
+	cmd := exec.CommandContext(ctx, s.Path, args...)
+	cmd.Stdin = bytes.NewReader(toLF(data))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return Fatalf("%s failed: %v: %s", s.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (s *SendmailCommand) Close() error {
+	return nil
+}
+
+func (s *SendmailFile) Send(to, from, subject string, body []byte) error {
+	return s.SendMessage(newMessage(to, from, subject, body))
+}
+
+// the envelope is recorded in X-Envelope headers ahead of the message
+func (s *SendmailFile) SendMessage(msg *Message) error {
+	from, recipients, data, err := s.prepare(msg)
+	if err != nil {
+		return Fatal(err)
+	}
+	return s.deliver(from, recipients, data)
+}
+
+func (s *SendmailFile) SendContext(ctx context.Context, msg *Message) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return s.SendMessage(msg)
+}
+
+func (s *SendmailFile) SendRaw(envelopeFrom string, recipients []string, r io.Reader) error {
+	r, err := s.prepareRaw(envelopeFrom, recipients, r)
+	if err != nil {
+		return Fatal(err)
+	}
+	// the local transports need the whole message in memory
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Fatal(err)
+	}
+	return s.deliver(envelopeFrom, recipients, toCRLF(data))
+}
+
+func (s *SendmailFile) deliver(from string, recipients []string, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("X-Envelope-From: <%s>\r\n", from))
+	buf.WriteString(fmt.Sprintf("X-Envelope-To: %s\r\n", strings.Join(recipients, ", ")))
+	buf.Write(data)
+	filename := filepath.Join(s.Dir, fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405"), uuid.New().String()))
+	err := writeFileAtomic(filename, buf.Bytes(), 0600)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+func (s *SendmailFile) Close() error {
+	return nil
+}
+
+func (s *SendmailMaildir) Send(to, from, subject string, body []byte) error {
+	return s.SendMessage(newMessage(to, from, subject, body))
+}
+
+// write the message to tmp and rename it into new as a delivery agent would
+func (s *SendmailMaildir) SendMessage(msg *Message) error {
+	from, _, data, err := s.prepare(msg)
+	if err != nil {
+		return Fatal(err)
+	}
+	return s.deliver(from, data)
+}
+
+func (s *SendmailMaildir) SendContext(ctx context.Context, msg *Message) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return s.SendMessage(msg)
+}
+
+func (s *SendmailMaildir) SendRaw(envelopeFrom string, recipients []string, r io.Reader) error {
+	r, err := s.prepareRaw(envelopeFrom, recipients, r)
+	if err != nil {
+		return Fatal(err)
+	}
+	// the local transports need the whole message in memory
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Fatal(err)
+	}
+	return s.deliver(envelopeFrom, data)
+}
+
+func (s *SendmailMaildir) deliver(from string, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Return-Path: <%s>\n", from))
+	buf.Write(toLF(data))
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%d_%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), uuid.New().String(), hostname)
+	tmpFile := filepath.Join(s.Dir, "tmp", name)
+	err = os.WriteFile(tmpFile, buf.Bytes(), 0600)
+	if err != nil {
+		return Fatal(err)
+	}
+	err = os.Rename(tmpFile, filepath.Join(s.Dir, "new", name))
+	if err != nil {
+		os.Remove(tmpFile)
+		return Fatal(err)
+	}
+	return nil
+}
+
+func (s *SendmailMaildir) Close() error {
+	return nil
+}
+
+// convert CRLF line endings to the local convention used by sendmail and Maildir
+func toLF(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// convert any mix of line endings to CRLF
+func toCRLF(data []byte) []byte {
+	return bytes.ReplaceAll(toLF(data), []byte("\n"), []byte("\r\n"))
+}
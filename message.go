@@ -0,0 +1,262 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Message is an outgoing mail message.  Address fields accept any form
+// net/mail can parse, and each element may hold a comma separated list.
+// Bcc recipients receive the message but are not written to the headers.
+// Body is the plain text part; when HTML is also set the two are sent as
+// alternatives.  MessageID, with or without angle brackets, and Date are
+// generated when empty.  DSN
+// overrides the smtp.dsn config defaults for this message.  Sender is
+// written as the Sender header when the message is sent on behalf of From.
+// ReturnPath is the envelope sender that receives bounces, defaulting to
+// Sender or From; "<>" sends with a null envelope sender.
+type Message struct {
+	From        string
+	Sender      string
+	ReturnPath  string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     []string
+	Subject     string
+	Body        []byte
+	HTML        []byte
+	Attachments []*Attachment
+	Inline      []*Attachment
+	MessageID   string
+	Date        time.Time
+	DSN         *DSNOptions
+	envelope    []string
+}
+
+func parseAddressList(field string, values []string) ([]*mail.Address, error) {
+	addrs := []*mail.Address{}
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			return nil, Fatalf("invalid %s address '%s': %v", field, value, err)
+		}
+		addrs = append(addrs, list...)
+	}
+	return addrs, nil
+}
+
+// display names are RFC 2047 encoded by mail.Address when not ASCII
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.String()
+}
+
+func formatAddressList(addrs []*mail.Address) string {
+	values := []string{}
+	for _, addr := range addrs {
+		values = append(values, formatAddress(addr))
+	}
+	return strings.Join(values, ", ")
+}
+
+// the bare address used for the SMTP MAIL FROM command: ReturnPath, Sender,
+// or From, in that order; empty for the null sender
+func (m *Message) EnvelopeFrom() (string, error) {
+	field, value := "From", m.From
+	switch {
+	case strings.TrimSpace(m.ReturnPath) == "<>":
+		return "", nil
+	case m.ReturnPath != "":
+		field, value = "Return-Path", m.ReturnPath
+	case m.Sender != "":
+		field, value = "Sender", m.Sender
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", Fatalf("invalid %s address '%s': %v", field, value, err)
+	}
+	return addr.Address, nil
+}
+
+// the bare To, Cc, and Bcc addresses with duplicates removed, or the
+// envelope recipients set by the mail queue when retrying some of them
+func (m *Message) Recipients() ([]string, error) {
+	if len(m.envelope) > 0 {
+		return m.envelope, nil
+	}
+	recipients := []string{}
+	seen := make(map[string]bool)
+	for _, field := range []struct {
+		name   string
+		values []string
+	}{
+		{"To", m.To},
+		{"Cc", m.Cc},
+		{"Bcc", m.Bcc},
+	} {
+		addrs, err := parseAddressList(field.name, field.values)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		for _, addr := range addrs {
+			key := strings.ToLower(addr.Address)
+			if !seen[key] {
+				seen[key] = true
+				recipients = append(recipients, addr.Address)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, Fatalf("message has no recipients")
+	}
+	return recipients, nil
+}
+
+func newMessage(to, from, subject string, body []byte) *Message {
+	return &Message{
+		From:    from,
+		To:      []string{to},
+		Subject: subject,
+		Body:    body,
+	}
+}
+
+// return the envelope sender, envelope recipients, and formatted message;
+// localName is the domain of a generated Message-ID
+func prepareMessage(msg *Message, localName string) (string, []string, []byte, error) {
+	from, err := msg.EnvelopeFrom()
+	if err != nil {
+		return "", nil, nil, Fatal(err)
+	}
+	recipients, err := msg.Recipients()
+	if err != nil {
+		return "", nil, nil, Fatal(err)
+	}
+	data, err := formatMessage(msg, localName)
+	if err != nil {
+		return "", nil, nil, Fatal(err)
+	}
+	return from, recipients, data, nil
+}
+
+// internationalized addresses can only be sent to a server offering SMTPUTF8
+func requiresSMTPUTF8(from string, recipients []string) bool {
+	for _, addr := range append([]string{from}, recipients...) {
+		if !isASCII(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatMessage(msg *Message, localName string) ([]byte, error) {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return nil, Fatalf("invalid From address '%s': %v", msg.From, err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("From: %s\r\n", formatAddress(from)))
+	if msg.Sender != "" {
+		sender, err := mail.ParseAddress(msg.Sender)
+		if err != nil {
+			return nil, Fatalf("invalid Sender address '%s': %v", msg.Sender, err)
+		}
+		buf.WriteString(fmt.Sprintf("Sender: %s\r\n", formatAddress(sender)))
+	}
+	for _, header := range []struct {
+		name   string
+		values []string
+	}{
+		{"To", msg.To},
+		{"Cc", msg.Cc},
+		{"Reply-To", msg.ReplyTo},
+	} {
+		addrs, err := parseAddressList(header.name, header.values)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		if len(addrs) > 0 {
+			buf.WriteString(fmt.Sprintf("%s: %s\r\n", header.name, formatAddressList(addrs)))
+		}
+	}
+	buf.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject)))
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := strings.Trim(strings.TrimSpace(msg.MessageID), "<>")
+	if messageID == "" {
+		messageID = generateMessageID(localName, msg.From)
+	}
+	buf.WriteString(fmt.Sprintf("Date: %s\r\n", date.Format(time.RFC1123Z)))
+	buf.WriteString(fmt.Sprintf("Message-ID: <%s>\r\n", messageID))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	root, err := buildMimeTree(msg)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	body, err := root.render()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	err = writeMimeHeader(&buf, root.header)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// read the header block of a pre-formatted message and prepend Date and
+// Message-ID when they are missing; the body is left to stream from r
+func addMissingHeaders(r io.Reader, localName, envelopeFrom string) (io.Reader, error) {
+	reader := bufio.NewReader(r)
+	var header bytes.Buffer
+	hasDate := false
+	hasMessageID := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, Fatal(err)
+		}
+		header.Write(line)
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 || err == io.EOF {
+			break
+		}
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			continue
+		}
+		name, _, found := bytes.Cut(trimmed, []byte(":"))
+		if !found {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(string(name))) {
+		case "date":
+			hasDate = true
+		case "message-id":
+			hasMessageID = true
+		}
+	}
+	var added bytes.Buffer
+	if !hasDate {
+		added.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	}
+	if !hasMessageID {
+		added.WriteString(fmt.Sprintf("Message-ID: <%s>\r\n", generateMessageID(localName, envelopeFrom)))
+	}
+	return io.MultiReader(&added, &header, reader), nil
+}
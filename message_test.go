@@ -0,0 +1,161 @@
+package common
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageRecipients(t *testing.T) {
+	msg := Message{
+		From:    "Sender <sender@example.com>",
+		To:      []string{"One <one@example.com>, two@example.com"},
+		Cc:      []string{"three@example.com", "TWO@example.com"},
+		Bcc:     []string{"hidden@example.com"},
+		ReplyTo: []string{"replies@example.com"},
+		Subject: "recipients",
+		Body:    []byte("howdy\n"),
+	}
+	recipients, err := msg.Recipients()
+	require.Nil(t, err)
+	require.Equal(t, []string{"one@example.com", "two@example.com", "three@example.com", "hidden@example.com"}, recipients)
+
+	from, err := msg.EnvelopeFrom()
+	require.Nil(t, err)
+	require.Equal(t, "sender@example.com", from)
+
+	msg.Sender = "Agent <agent@example.com>"
+	from, err = msg.EnvelopeFrom()
+	require.Nil(t, err)
+	require.Equal(t, "agent@example.com", from)
+	msg.ReturnPath = "<>"
+	from, err = msg.EnvelopeFrom()
+	require.Nil(t, err)
+	require.Equal(t, "", from)
+	msg.Sender = ""
+	msg.ReturnPath = ""
+
+	data, err := formatMessage(&msg, "")
+	require.Nil(t, err)
+	text := string(data)
+	require.Contains(t, text, "To: \"One\" <one@example.com>, two@example.com\r\n")
+	require.Contains(t, text, "Cc: three@example.com, TWO@example.com\r\n")
+	require.Contains(t, text, "Reply-To: replies@example.com\r\n")
+	require.False(t, strings.Contains(text, "hidden@example.com"))
+
+	// a caller's Message-ID is written with exactly one pair of brackets
+	for _, id := range []string{"abc@example.com", "<abc@example.com>"} {
+		msg.MessageID = id
+		data, err = formatMessage(&msg, "")
+		require.Nil(t, err)
+		require.Contains(t, string(data), "Message-ID: <abc@example.com>\r\n")
+	}
+
+	// a generated Message-ID uses the local name
+	msg.MessageID = ""
+	data, err = formatMessage(&msg, "mail.example.net")
+	require.Nil(t, err)
+	require.Regexp(t, "Message-ID: <[^@>]+@mail.example.net>\r\n", string(data))
+
+	_, err = (&Message{From: "sender@example.com", To: []string{"not an address"}}).Recipients()
+	require.NotNil(t, err)
+}
+
+func TestMessageMime(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "report.csv")
+	require.Nil(t, os.WriteFile(csvFile, []byte("a,b\n1,2\n"), 0600))
+	imageFile := filepath.Join(dir, "logo.png")
+	require.Nil(t, os.WriteFile(imageFile, []byte("\x89PNG\r\n\x1a\nnot really"), 0600))
+
+	msg := Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "mime",
+		Body:    []byte("plain text\n"),
+	}
+	cid, err := msg.Embed(imageFile)
+	require.Nil(t, err)
+	msg.HTML = []byte(`<p>html</p><img src="cid:` + cid + `">`)
+	require.Nil(t, msg.Attach(csvFile))
+
+	data, err := formatMessage(&msg, "")
+	require.Nil(t, err)
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Equal(t, "1.0", parsed.Header.Get("MIME-Version"))
+
+	// walk the tree, recording the content type of each part
+	types := []string{}
+	var walk func(contentType string, body io.Reader)
+	walk = func(contentType string, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		require.Nil(t, err)
+		types = append(types, mediaType)
+		if mediaType == "multipart/related" {
+			require.Equal(t, "text/html", params["type"])
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.Nil(t, err)
+			if mediaType == "multipart/related" && part.Header.Get("Content-ID") != "" {
+				require.Equal(t, "<"+cid+">", part.Header.Get("Content-ID"))
+			}
+			walk(part.Header.Get("Content-Type"), part)
+		}
+	}
+	walk(parsed.Header.Get("Content-Type"), parsed.Body)
+	require.Equal(t, []string{
+		"multipart/mixed",
+		"multipart/alternative",
+		"text/plain",
+		"multipart/related",
+		"text/html",
+		"image/png",
+	}, types[:6])
+	// csv may be detected from the system mime table or the content
+	require.Len(t, types, 7)
+	require.True(t, strings.HasPrefix(types[6], "text/"))
+}
+
+func TestMessageInternational(t *testing.T) {
+	msg := Message{
+		From:    "Jürgen Müller <juergen@example.com>",
+		To:      []string{"José <jose@example.com>"},
+		Subject: "Grüße aus Köln",
+		Body:    []byte("Schöne Grüße\n"),
+	}
+	data, err := formatMessage(&msg, "")
+	require.Nil(t, err)
+	require.True(t, isASCII(string(data)))
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	require.Nil(t, err)
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(parsed.Header.Get("Subject"))
+	require.Nil(t, err)
+	require.Equal(t, msg.Subject, subject)
+	from, err := parsed.Header.AddressList("From")
+	require.Nil(t, err)
+	require.Equal(t, "Jürgen Müller", from[0].Name)
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	require.Equal(t, "utf-8", params["charset"])
+
+	require.False(t, requiresSMTPUTF8("juergen@example.com", []string{"jose@example.com"}))
+	require.True(t, requiresSMTPUTF8("juergen@example.com", []string{"josé@exämple.com"}))
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+)
+
+// Attachment is a file carried in a message; inline attachments are
+// referenced from the HTML body as cid:ContentID
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// read an attachment from a file, detecting its content type from the
+// filename extension or the file contents
+func NewAttachment(filename string) (*Attachment, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return &Attachment{
+		Filename:    filepath.Base(filename),
+		ContentType: detectContentType(filename, data),
+		Data:        data,
+	}, nil
+}
+
+func detectContentType(filename string, data []byte) string {
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return contentType
+}
+
+// add a file as an attachment
+func (m *Message) Attach(filename string) error {
+	attachment, err := NewAttachment(filename)
+	if err != nil {
+		return Fatal(err)
+	}
+	m.Attachments = append(m.Attachments, attachment)
+	return nil
+}
+
+// add a file as an inline part of the HTML body, returning the content id
+// to use in the HTML as src="cid:<id>"; its domain is the smtp.local_name
+// config value or the host FQDN, like a generated Message-ID
+func (m *Message) Embed(filename string) (string, error) {
+	attachment, err := NewAttachment(filename)
+	if err != nil {
+		return "", Fatal(err)
+	}
+	attachment.ContentID = fmt.Sprintf("%s@%s", uuid.New().String(), idDomain(localName(""), m.From))
+	m.Inline = append(m.Inline, attachment)
+	return attachment.ContentID, nil
+}
+
+// mimePart is a node in the tree built for a message body; leaf parts carry
+// encoded content and multipart parts carry children
+type mimePart struct {
+	header   textproto.MIMEHeader
+	body     []byte
+	subtype  string
+	children []*mimePart
+}
+
+func newTextPart(contentType string, text []byte) (*mimePart, error) {
+	var buf bytes.Buffer
+	writer := quotedprintable.NewWriter(&buf)
+	_, err := writer.Write(text)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	charset := "us-ascii"
+	if !isASCII(string(text)) {
+		charset = "utf-8"
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": charset}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &mimePart{header: header, body: buf.Bytes()}, nil
+}
+
+func newAttachmentPart(attachment *Attachment, disposition string) *mimePart {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = detectContentType(attachment.Filename, attachment.Data)
+	}
+	header := make(textproto.MIMEHeader)
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+		params = map[string]string{}
+	}
+	if attachment.Filename != "" {
+		params["name"] = attachment.Filename
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	header.Set("Content-Transfer-Encoding", "base64")
+	if attachment.ContentID != "" {
+		header.Set("Content-ID", "<"+attachment.ContentID+">")
+	}
+	return &mimePart{header: header, body: encodeBase64Lines(attachment.Data)}
+}
+
+func newMultipart(subtype string, children ...*mimePart) *mimePart {
+	return &mimePart{subtype: subtype, children: children}
+}
+
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// base64 encode data with lines no longer than 76 characters
+func encodeBase64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	if len(encoded) > 0 {
+		buf.WriteString(encoded + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// build the body tree: an optional plain text and HTML alternative, the HTML
+// related to its inline parts, all mixed with any attachments
+func buildMimeTree(msg *Message) (*mimePart, error) {
+	var body *mimePart
+	var text *mimePart
+	var err error
+	if msg.Body != nil || msg.HTML == nil {
+		text, err = newTextPart("text/plain", msg.Body)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	body = text
+	if msg.HTML != nil {
+		html, err := newTextPart("text/html", msg.HTML)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		if len(msg.Inline) > 0 {
+			related := newMultipart("related", html)
+			for _, inline := range msg.Inline {
+				related.children = append(related.children, newAttachmentPart(inline, "inline"))
+			}
+			html = related
+		}
+		if text != nil {
+			body = newMultipart("alternative", text, html)
+		} else {
+			body = html
+		}
+	}
+	if len(msg.Attachments) > 0 {
+		mixed := newMultipart("mixed", body)
+		for _, attachment := range msg.Attachments {
+			mixed.children = append(mixed.children, newAttachmentPart(attachment, "attachment"))
+		}
+		body = mixed
+	}
+	return body, nil
+}
+
+// write the part's body; for multipart parts the boundary is generated here
+// and the Content-Type header is set to carry it
+func (p *mimePart) render() ([]byte, error) {
+	if p.subtype == "" {
+		return p.body, nil
+	}
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, child := range p.children {
+		childBody, err := child.render()
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		fp, err := writer.CreatePart(child.header)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		_, err = fp.Write(childBody)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	params := map[string]string{"boundary": writer.Boundary()}
+	// RFC 2387 requires the type of the root part, which comes first
+	if p.subtype == "related" && len(p.children) > 0 {
+		rootType, _, err := mime.ParseMediaType(p.children[0].header.Get("Content-Type"))
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		params["type"] = rootType
+	}
+	p.header = make(textproto.MIMEHeader)
+	p.header.Set("Content-Type", mime.FormatMediaType("multipart/"+p.subtype, params))
+	return buf.Bytes(), nil
+}
+
+func writeMimeHeader(w io.Writer, header textproto.MIMEHeader) error {
+	keys := []string{}
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			_, err := fmt.Fprintf(w, "%s: %s\r\n", key, value)
+			if err != nil {
+				return Fatal(err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+type netrcEntry struct {
+	Machine  string
+	Login    string
+	Password string
+	Account  string
+}
+
+// return the .netrc pathname from config, the NETRC environment variable,
+// or the default location in the user's home directory; the config value
+// and NETRC are both expanded, ViperGetString expanding the config value
+func netrcFilename(prefix string) (string, error) {
+	filename := ViperGetString(prefix + "api_client.netrc_file")
+	if filename == "" {
+		filename = Expand(os.Getenv("NETRC"))
+	}
+	if filename != "" {
+		return filename, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", Fatal(err)
+	}
+	if runtime.GOOS == "windows" {
+		filename = filepath.Join(home, "_netrc")
+		if IsFile(filename) {
+			return filename, nil
+		}
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+func readNetrc(filename string) ([]netrcEntry, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0044 != 0 {
+		Warning("%s is readable by other users (mode %04o)", filename, info.Mode().Perm())
+	}
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	defer fp.Close()
+
+	entries := []netrcEntry{}
+	current := -1
+	var inMacro bool
+	var keyword string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// a macro definition ends at the first blank line
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, token := range strings.Fields(line) {
+			if keyword != "" {
+				switch keyword {
+				case "machine":
+					entries = append(entries, netrcEntry{Machine: token})
+					current = len(entries) - 1
+				case "login":
+					if current >= 0 {
+						entries[current].Login = token
+					}
+				case "password":
+					if current >= 0 {
+						entries[current].Password = token
+					}
+				case "account":
+					if current >= 0 {
+						entries[current].Account = token
+					}
+				}
+				keyword = ""
+				continue
+			}
+			switch token {
+			case "machine", "login", "password", "account":
+				keyword = token
+			case "default":
+				entries = append(entries, netrcEntry{})
+				current = len(entries) - 1
+			case "macdef":
+				inMacro = true
+			}
+			if inMacro {
+				break
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return entries, nil
+}
+
+// return the entry for host, falling back to the default entry if present
+func lookupNetrc(entries []netrcEntry, host string) (netrcEntry, bool) {
+	for _, entry := range entries {
+		if entry.Machine != "" && strings.EqualFold(entry.Machine, host) {
+			return entry, true
+		}
+	}
+	for _, entry := range entries {
+		if entry.Machine == "" {
+			return entry, true
+		}
+	}
+	return netrcEntry{}, false
+}
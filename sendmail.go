@@ -2,42 +2,295 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"mime/quotedprintable"
+	"io"
+	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const DEFAULT_SMTP_TIMEOUT = 30
+
+// SMTP connection security modes
+const SMTP_SECURITY_TLS = "tls"
+const SMTP_SECURITY_STARTTLS = "starttls"
+const SMTP_SECURITY_OPPORTUNISTIC = "opportunistic"
+const SMTP_SECURITY_NONE = "none"
+
 type Sendmail interface {
 	Send(to, from, subject string, body []byte) error
+	SendMessage(msg *Message) error
+	SendContext(ctx context.Context, msg *Message) error
+	SendRaw(envelopeFrom string, recipients []string, r io.Reader) error
+	Close() error
+}
+
+// sendmailOptions holds the settings shared by every transport
+type sendmailOptions struct {
+	DKIM       *DKIMSigner
+	DSN        *DSNOptions
+	RawHeaders bool
+	LocalName  string
+}
+
+// sendmailTransport is implemented by each transport to accept shared options
+type sendmailTransport interface {
+	Sendmail
+	setOptions(options sendmailOptions)
+	identity() string
+}
+
+func newSendmailOptions(prefix string) (*sendmailOptions, error) {
+	options := sendmailOptions{}
+	signer, err := newDKIMSignerFromConfig(prefix)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	options.DKIM = signer
+	options.DSN, err = newDSNOptionsFromConfig(prefix)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	options.RawHeaders = ViperGetBool(prefix + "smtp.raw_add_headers")
+	options.LocalName = localName(prefix)
+	return &options, nil
+}
+
+func (o *sendmailOptions) setOptions(options sendmailOptions) {
+	*o = options
+}
+
+// the configured local name, used for generated Message-IDs
+func (o *sendmailOptions) identity() string {
+	return o.LocalName
+}
+
+// format the message and sign it when DKIM is configured
+func (o *sendmailOptions) prepare(msg *Message) (string, []string, []byte, error) {
+	from, recipients, data, err := prepareMessage(msg, o.LocalName)
+	if err != nil {
+		return "", nil, nil, Fatal(err)
+	}
+	if o.DKIM != nil {
+		data, err = o.DKIM.Sign(data)
+		if err != nil {
+			return "", nil, nil, Fatal(err)
+		}
+	}
+	return from, recipients, data, nil
+}
+
+// the message's DSN options, or the configured defaults
+func (o *sendmailOptions) dsnOptions(msg *Message) (*DSNOptions, error) {
+	if msg.DSN == nil {
+		return o.DSN, nil
+	}
+	err := msg.DSN.validate()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return msg.DSN, nil
 }
 
+// prepare a pre-formatted message, adding missing Date and Message-ID
+// headers when RawHeaders is set and signing it when DKIM is configured;
+// unless signing, the message is streamed rather than read into memory
+func (o *sendmailOptions) prepareRaw(envelopeFrom string, recipients []string, r io.Reader) (io.Reader, error) {
+	if len(recipients) == 0 {
+		return nil, Fatalf("message has no recipients")
+	}
+	var err error
+	if o.RawHeaders {
+		r, err = addMissingHeaders(r, o.LocalName, envelopeFrom)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+	if o.DKIM != nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		data, err = o.DKIM.Sign(toCRLF(data))
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	return r, nil
+}
+
+// RecipientError is returned when the server rejects some or all of the
+// recipients; the message was delivered to the Accepted addresses, if any
+type RecipientError struct {
+	Accepted []string
+	Rejected map[string]error
+}
+
+func (e *RecipientError) Error() string {
+	addrs := []string{}
+	for addr := range e.Rejected {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	failures := []string{}
+	for _, addr := range addrs {
+		failures = append(failures, fmt.Sprintf("%s: %v", addr, e.Rejected[addr]))
+	}
+	return fmt.Sprintf("recipients rejected: %s", strings.Join(failures, "; "))
+}
+
+// SendmailClient keeps one SMTP session open across calls to Send; call Close
+// when finished to end the session.  Timeout applies to the dial, the TLS
+// handshake, and each command unless the specific timeout is set.
 type SendmailClient struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	CAFile   string
-	c        *smtp.Client
+	sendmailOptions
+	Host           string
+	Port           int
+	Username       string
+	Password       string
+	CAFile         string
+	Security       string
+	Auth           string
+	TokenSource    TokenSource
+	Timeout        time.Duration
+	DialTimeout    time.Duration
+	TLSTimeout     time.Duration
+	CommandTimeout time.Duration
+	c              *smtp.Client
+	conn           net.Conn
+	connLock       sync.Mutex
+	tlsConfig      *tls.Config
+	authenticated  bool
+	unverified     bool
+	mechanism      string
+	mutex          sync.Mutex
+}
+
+// SMTPStatus describes a verified SMTP session
+type SMTPStatus struct {
+	Host       string            `json:"host"`
+	Port       int               `json:"port"`
+	Security   string            `json:"security"`
+	TLS        bool              `json:"tls"`
+	TLSVersion string            `json:"tls_version,omitempty"`
+	Auth       string            `json:"auth,omitempty"`
+	LocalName  string            `json:"local_name"`
+	Extensions map[string]string `json:"extensions"`
 }
 
+// EHLO keywords reported by Verify
+var smtpExtensions = []string{"8BITMIME", "AUTH", "BINARYMIME", "CHUNKING", "DSN", "ENHANCEDSTATUSCODES", "PIPELINING", "SIZE", "SMTPUTF8", "STARTTLS"}
+
+// the smtp.transport config key selects an alternative to SMTP delivery, in
+// which case the connection arguments are ignored
 func NewSendmail(hostname string, port int, username, password, CAFile string) (Sendmail, error) {
+	return newSendmail(context.Background(), "", hostname, port, username, password, CAFile)
+}
+
+// NewSendmailContext is NewSendmail with the initial connection bounded by ctx
+func NewSendmailContext(ctx context.Context, hostname string, port int, username, password, CAFile string) (Sendmail, error) {
+	return newSendmail(ctx, "", hostname, port, username, password, CAFile)
+}
+
+// configure from the smtp section under prefix: hostname, port, username,
+// password (or @file), cafile, security, auth, token, local_name, transport,
+// the dsn defaults, and the timeouts read by setTimeouts
+func NewSendmailFromConfig(prefix string) (Sendmail, error) {
+	missing := []string{}
+	transport := strings.ToLower(ViperGetString(prefix + "smtp.transport"))
+	switch transport {
+	case "", SMTP_TRANSPORT_SMTP:
+		if ViperGetString(prefix+"smtp.hostname") == "" {
+			missing = append(missing, ViperKey(prefix+"smtp.hostname"))
+		}
+		if ViperGetString(prefix+"smtp.username") != "" && ViperGetString(prefix+"smtp.password") == "" && ViperGetString(prefix+"smtp.token") == "" {
+			missing = append(missing, ViperKey(prefix+"smtp.password"))
+		}
+	case SMTP_TRANSPORT_FILE:
+		if ViperGetString(prefix+"smtp.file_dir") == "" {
+			missing = append(missing, ViperKey(prefix+"smtp.file_dir"))
+		}
+	case SMTP_TRANSPORT_MAILDIR:
+		if ViperGetString(prefix+"smtp.maildir") == "" {
+			missing = append(missing, ViperKey(prefix+"smtp.maildir"))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, Fatalf("missing config: %s", strings.Join(missing, ", "))
+	}
+	return newSendmail(
+		context.Background(),
+		prefix,
+		ViperGetString(prefix+"smtp.hostname"),
+		ViperGetInt(prefix+"smtp.port"),
+		ViperGetString(prefix+"smtp.username"),
+		ViperGetString(prefix+"smtp.password"),
+		ViperGetString(prefix+"smtp.cafile"),
+	)
+}
+
+func newSendmail(ctx context.Context, prefix, hostname string, port int, username, password, CAFile string) (Sendmail, error) {
+
+	options, err := newSendmailOptions(prefix)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	var sender Sendmail
+	transport := strings.ToLower(ViperGetString(prefix + "smtp.transport"))
+	switch transport {
+	case "", SMTP_TRANSPORT_SMTP:
+	case SMTP_TRANSPORT_SENDMAIL:
+		sender, err = NewSendmailCommand(ViperGetString(prefix + "smtp.sendmail_path"))
+	case SMTP_TRANSPORT_FILE:
+		sender, err = NewSendmailFile(ViperGetString(prefix + "smtp.file_dir"))
+	case SMTP_TRANSPORT_MAILDIR:
+		sender, err = NewSendmailMaildir(ViperGetString(prefix + "smtp.maildir"))
+	default:
+		return nil, Fatalf("unknown smtp transport: %s", transport)
+	}
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if sender != nil {
+		sender.(sendmailTransport).setOptions(*options)
+		return sender, nil
+	}
 
 	c := SendmailClient{
-		Host:     hostname,
-		Port:     port,
-		Username: username,
-		Password: password,
-		CAFile:   CAFile,
+		Host:            hostname,
+		Port:            port,
+		Username:        username,
+		Password:        password,
+		CAFile:          CAFile,
+		Security:        strings.ToLower(ViperGetString(prefix + "smtp.security")),
+		Auth:            strings.ToLower(ViperGetString(prefix + "smtp.auth")),
+		sendmailOptions: *options,
+	}
+	c.setTimeouts(prefix)
+	if c.Host == "" {
+		return nil, Fatalf("missing SMTP hostname")
 	}
-	if c.Port == 0 {
-		c.Port = 465
+	token := ViperGetString(prefix + "smtp.token")
+	if token != "" {
+		c.TokenSource = FileTokenSource(token)
+	}
+	err = c.setSecurity()
+	if err != nil {
+		return nil, Fatal(err)
 	}
 	caCertPool := x509.NewCertPool()
 	if c.CAFile != "" {
@@ -57,26 +310,320 @@ func NewSendmail(hostname string, port int, username, password, CAFile string) (
 		}
 	}
 
-	tlsConfig := &tls.Config{
+	c.tlsConfig = &tls.Config{
 		RootCAs:    caCertPool,
 		ServerName: c.Host,
 	}
 
-	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port), tlsConfig)
+	// connection failures are returned as *SMTPError
+	err = c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = readPassword(c.Password)
 	if err != nil {
 		return nil, Fatal(err)
 	}
+	return &c, nil
+}
 
+// choose the security mode from the port when not configured, and the port
+// from the mode when not given
+func (c *SendmailClient) setSecurity() error {
+	if c.Security == "" {
+		switch c.Port {
+		case 25:
+			c.Security = SMTP_SECURITY_OPPORTUNISTIC
+		case 587:
+			c.Security = SMTP_SECURITY_STARTTLS
+		default:
+			c.Security = SMTP_SECURITY_TLS
+		}
+	}
+	switch c.Security {
+	case SMTP_SECURITY_TLS:
+		if c.Port == 0 {
+			c.Port = 465
+		}
+	case SMTP_SECURITY_STARTTLS:
+		if c.Port == 0 {
+			c.Port = 587
+		}
+	case SMTP_SECURITY_OPPORTUNISTIC:
+		if c.Port == 0 {
+			c.Port = 25
+		}
+	case SMTP_SECURITY_NONE:
+		if !isLocalhost(c.Host) {
+			return Fatalf("security mode '%s' is only allowed for localhost, not %s", c.Security, c.Host)
+		}
+		if c.Port == 0 {
+			c.Port = 25
+		}
+	default:
+		return Fatalf("unknown SMTP security mode: %s", c.Security)
+	}
+	return nil
+}
+
+func isLocalhost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// read timeout, dial_timeout, tls_timeout, and command_timeout from the smtp
+// section; the specific timeouts default to the general one
+func (c *SendmailClient) setTimeouts(prefix string) {
+	ViperSetDefault(prefix+"smtp.timeout", DEFAULT_SMTP_TIMEOUT)
+	c.Timeout = time.Duration(ViperGetInt64(prefix+"smtp.timeout")) * time.Second
+	c.DialTimeout = time.Duration(ViperGetInt64(prefix+"smtp.dial_timeout")) * time.Second
+	c.TLSTimeout = time.Duration(ViperGetInt64(prefix+"smtp.tls_timeout")) * time.Second
+	c.CommandTimeout = time.Duration(ViperGetInt64(prefix+"smtp.command_timeout")) * time.Second
+}
+
+// a specific timeout, or the general one when it is not set
+func (c *SendmailClient) timeout(specific time.Duration) time.Duration {
+	if specific > 0 {
+		return specific
+	}
+	return c.Timeout
+}
+
+func (c *SendmailClient) connect(ctx context.Context) error {
+	return c.dial(ctx, true)
+}
+
+// open a session; verify is false only when opportunistic STARTTLS has
+// failed certificate verification and is retried without it
+func (c *SendmailClient) dial(ctx context.Context, verify bool) error {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	dialer := net.Dialer{Timeout: c.timeout(c.DialTimeout)}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return newSMTPError(SMTP_STAGE_DIAL, err)
+	}
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+
+	if c.Security == SMTP_SECURITY_TLS {
+		tlsCtx := ctx
+		if timeout := c.timeout(c.TLSTimeout); timeout > 0 {
+			var cancel context.CancelFunc
+			tlsCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		err = tlsConn.HandshakeContext(tlsCtx)
+		if err != nil {
+			c.disconnect()
+			return newSMTPError(SMTP_STAGE_DIAL, err)
+		}
+		conn = tlsConn
+	}
+
+	// the greeting and EHLO
+	stop := c.watch(ctx)
+	defer stop()
+	err = c.setDeadline(ctx, c.CommandTimeout)
+	if err != nil {
+		c.disconnect()
+		return newSMTPError(SMTP_STAGE_DIAL, err)
+	}
 	c.c, err = smtp.NewClient(conn, c.Host)
 	if err != nil {
-		return nil, Fatal(err)
+		c.disconnect()
+		return c.fail(ctx, SMTP_STAGE_DIAL, err)
 	}
+	err = c.c.Hello(c.helloName())
+	if err != nil {
+		c.disconnect()
+		return c.fail(ctx, SMTP_STAGE_DIAL, err)
+	}
+	c.authenticated = false
+	c.mechanism = ""
+	c.unverified = false
 
-	_, err = readPassword(c.Password)
+	switch c.Security {
+	case SMTP_SECURITY_STARTTLS, SMTP_SECURITY_OPPORTUNISTIC:
+		err = c.setDeadline(ctx, c.TLSTimeout)
+		if err != nil {
+			c.disconnect()
+			return newSMTPError(SMTP_STAGE_DIAL, err)
+		}
+		ok, _ := c.c.Extension("STARTTLS")
+		if !ok {
+			if c.Security == SMTP_SECURITY_STARTTLS {
+				c.disconnect()
+				return newSMTPClientError(SMTP_STAGE_DIAL, 530, "5.7.10 server %s does not offer STARTTLS", c.Host)
+			}
+			return nil
+		}
+		tlsConfig := c.tlsConfig
+		if !verify {
+			tlsConfig = c.tlsConfig.Clone()
+			tlsConfig.InsecureSkipVerify = true
+		}
+		err = c.c.StartTLS(tlsConfig)
+		if err != nil {
+			c.disconnect()
+			// opportunistic TLS still encrypts when the certificate does not
+			// verify, but the session is never authenticated
+			if c.Security == SMTP_SECURITY_OPPORTUNISTIC && verify && ctx.Err() == nil {
+				Warning("STARTTLS to %s failed, continuing unverified and unauthenticated: %v", c.Host, err)
+				return c.dial(ctx, false)
+			}
+			return c.fail(ctx, SMTP_STAGE_DIAL, err)
+		}
+		c.unverified = !verify
+	}
+	return nil
+}
+
+// drop the connection without the QUIT handshake
+func (c *SendmailClient) disconnect() {
+	if c.c != nil {
+		c.c.Close()
+		c.c = nil
+	}
+	c.connLock.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.connLock.Unlock()
+}
+
+// set the deadline for the next exchange with the server; it fails once
+// the context has ended so a cancelled watch cannot be overridden
+func (c *SendmailClient) setDeadline(ctx context.Context, timeout time.Duration) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	err := ctx.Err()
 	if err != nil {
-		return nil, Fatal(err)
+		return err
 	}
-	return &c, nil
+	if c.conn == nil {
+		return nil
+	}
+	deadline := time.Time{}
+	if timeout = c.timeout(timeout); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	return c.conn.SetDeadline(deadline)
+}
+
+// unblock any pending I/O when the context ends; call the returned
+// function when the conversation is finished
+func (c *SendmailClient) watch(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		c.connLock.Lock()
+		defer c.connLock.Unlock()
+		if c.conn != nil {
+			c.conn.SetDeadline(time.Now())
+		}
+	})
+}
+
+// report a failed step; once the context has ended the session is
+// unusable and the context error replaces the I/O error it caused
+func (c *SendmailClient) fail(ctx context.Context, stage string, err error) *SMTPError {
+	if ctx.Err() != nil {
+		c.disconnect()
+		return newSMTPError(stage, ctx.Err())
+	}
+	return newSMTPError(stage, err)
+}
+
+// prepare the session for a new transaction, reconnecting if the server has
+// dropped the connection and authenticating if not yet done on this session
+func (c *SendmailClient) ready(ctx context.Context) error {
+	if c.c != nil {
+		err := c.setDeadline(ctx, c.CommandTimeout)
+		if err == nil {
+			err = c.c.Reset()
+		}
+		if err != nil {
+			c.disconnect()
+		}
+	}
+	if c.c == nil {
+		err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.authenticated {
+		err := c.setDeadline(ctx, c.CommandTimeout)
+		if err != nil {
+			return c.fail(ctx, SMTP_STAGE_AUTH, err)
+		}
+		err = c.authenticate()
+		if err != nil {
+			if ctx.Err() != nil {
+				return c.fail(ctx, SMTP_STAGE_AUTH, err)
+			}
+			return err
+		}
+		c.authenticated = true
+	}
+	return nil
+}
+
+// Verify connects and authenticates if necessary, reporting the session's
+// security and the extensions the server advertises without sending mail
+func (c *SendmailClient) Verify(ctx context.Context) (*SMTPStatus, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stop := c.watch(ctx)
+	defer stop()
+	err := c.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := SMTPStatus{
+		Host:       c.Host,
+		Port:       c.Port,
+		Security:   c.Security,
+		Auth:       c.mechanism,
+		LocalName:  c.helloName(),
+		Extensions: make(map[string]string),
+	}
+	state, ok := c.c.TLSConnectionState()
+	if ok {
+		status.TLS = true
+		status.TLSVersion = tls.VersionName(state.Version)
+	}
+	for _, name := range smtpExtensions {
+		ok, params := c.c.Extension(name)
+		if ok {
+			status.Extensions[name] = params
+		}
+	}
+	return &status, nil
+}
+
+// end the SMTP session; a later Send will open a new one
+func (c *SendmailClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.c == nil {
+		return nil
+	}
+	err := c.setDeadline(context.Background(), c.CommandTimeout)
+	if err == nil {
+		err = c.c.Quit()
+	}
+	if err != nil {
+		c.disconnect()
+		return newSMTPError(SMTP_STAGE_QUIT, err)
+	}
+	c.disconnect()
+	return nil
 }
 
 func readPassword(password string) (string, error) {
@@ -92,76 +639,244 @@ func readPassword(password string) (string, error) {
 }
 
 func (c *SendmailClient) Send(to, from, subject string, body []byte) error {
+	return c.SendMessage(newMessage(to, from, subject, body))
+}
+
+func (c *SendmailClient) SendMessage(msg *Message) error {
+	return c.SendContext(context.Background(), msg)
+}
 
-	password, err := readPassword(c.Password)
+// SendContext is SendMessage ending the SMTP conversation when ctx ends;
+// the connection is then dropped and the error wraps ctx.Err()
+func (c *SendmailClient) SendContext(ctx context.Context, msg *Message) error {
+	from, recipients, data, err := c.prepare(msg)
 	if err != nil {
 		return Fatal(err)
 	}
-
-	err = c.c.Auth(smtp.PlainAuth("", c.Username, password, c.Host))
+	dsn, err := c.dsnOptions(msg)
 	if err != nil {
 		return Fatal(err)
 	}
+	return c.send(ctx, from, recipients, bytes.NewReader(data), dsn)
+}
 
-	err = c.c.Mail(from)
+// SendRaw sends a complete message as-is; the DATA writer applies
+// dot-stuffing and CRLF line endings
+func (c *SendmailClient) SendRaw(envelopeFrom string, recipients []string, r io.Reader) error {
+	r, err := c.prepareRaw(envelopeFrom, recipients, r)
 	if err != nil {
 		return Fatal(err)
 	}
-	err = c.c.Rcpt(to)
+	return c.send(context.Background(), envelopeFrom, recipients, r, c.DSN)
+}
+
+// run one mail transaction on the session; failures are returned as
+// *SMTPError, or *RecipientError when recipients were rejected
+func (c *SendmailClient) send(ctx context.Context, from string, recipients []string, r io.Reader, dsn *DSNOptions) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// the watch covers RSET, any reconnect, and AUTH in ready
+	stop := c.watch(ctx)
+	defer stop()
+	err := c.ready(ctx)
+	if err != nil {
+		return err
+	}
+
+	if requiresSMTPUTF8(from, recipients) {
+		ok, _ := c.c.Extension("SMTPUTF8")
+		if !ok {
+			return newSMTPClientError(SMTP_STAGE_MAIL, 553, "5.6.7 server %s does not support SMTPUTF8 required for internationalized addresses", c.Host)
+		}
+	}
+
+	// MAIL and RCPT are issued directly since net/smtp cannot add parameters
+	params := []string{}
+	size := readerSize(r)
+	if ok, limit := c.c.Extension("SIZE"); ok && size >= 0 {
+		max, err := strconv.ParseInt(limit, 10, 64)
+		if err == nil && max > 0 && size > max {
+			return newSMTPClientError(SMTP_STAGE_MAIL, 552, "5.3.4 message size %d exceeds server limit %d", size, max)
+		}
+		params = append(params, fmt.Sprintf("SIZE=%d", size))
+	}
+	if ok, _ := c.c.Extension("8BITMIME"); ok {
+		params = append(params, "BODY=8BITMIME")
+	}
+	if requiresSMTPUTF8(from, recipients) {
+		params = append(params, "SMTPUTF8")
+	}
+	useDSN, _ := c.c.Extension("DSN")
+	useDSN = useDSN && dsn != nil
+	if useDSN {
+		params = append(params, dsn.mailParams()...)
+	}
+	err = c.command(ctx, 250, "MAIL FROM:<%s>%s", from, formatParams(params))
 	if err != nil {
-		return Fatal(err)
+		return c.fail(ctx, SMTP_STAGE_MAIL, err)
 	}
 
+	// keep going when a recipient is rejected so each failure is reported
+	rcptErr := RecipientError{Accepted: []string{}, Rejected: make(map[string]error)}
+	for _, to := range recipients {
+		params = []string{}
+		if useDSN {
+			params = dsn.rcptParams(to)
+		}
+		err = c.command(ctx, 25, "RCPT TO:<%s>%s", to, formatParams(params))
+		var protoErr *textproto.Error
+		if err != nil && !errors.As(err, &protoErr) {
+			return c.fail(ctx, SMTP_STAGE_RCPT, err)
+		}
+		if err != nil {
+			rcptErr.Rejected[to] = newSMTPError(SMTP_STAGE_RCPT, err)
+			continue
+		}
+		rcptErr.Accepted = append(rcptErr.Accepted, to)
+	}
+	if len(rcptErr.Accepted) == 0 {
+		return &rcptErr
+	}
+
+	err = c.setDeadline(ctx, c.CommandTimeout)
+	if err != nil {
+		return c.fail(ctx, SMTP_STAGE_DATA, err)
+	}
 	fp, err := c.c.Data()
 	if err != nil {
-		return Fatal(err)
+		return c.fail(ctx, SMTP_STAGE_DATA, err)
 	}
 
-	data, err := formatMessage(to, from, subject, body)
-	_, err = fp.Write(data)
+	_, err = io.Copy(&deadlineWriter{w: fp, c: c, ctx: ctx}, r)
 	if err != nil {
-		return Fatal(err)
+		fp.Close()
+		return c.fail(ctx, SMTP_STAGE_DATA, err)
 	}
 
-	err = fp.Close()
+	err = c.setDeadline(ctx, c.CommandTimeout)
+	if err == nil {
+		err = fp.Close()
+	}
 	if err != nil {
-		return Fatal(err)
+		return c.fail(ctx, SMTP_STAGE_DATA, err)
 	}
 
-	c.c.Quit()
+	if len(rcptErr.Rejected) > 0 {
+		return &rcptErr
+	}
 	return nil
 }
 
+// deadlineWriter extends the command deadline for each block of message
+// data so a large message is not limited by the command timeout
+type deadlineWriter struct {
+	w   io.Writer
+	c   *SendmailClient
+	ctx context.Context
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	err := w.c.setDeadline(w.ctx, w.c.CommandTimeout)
+	if err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// send one command and read its reply, which must start with expect; an
+// argument containing CR or LF is refused with the 501 a server would send
+func (c *SendmailClient) command(ctx context.Context, expect int, format string, args ...interface{}) error {
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return &textproto.Error{Code: 501, Msg: "5.5.2 command argument contains CR or LF"}
+		}
+	}
+	err := c.setDeadline(ctx, c.CommandTimeout)
+	if err != nil {
+		return err
+	}
+	id, err := c.c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.c.Text.StartResponse(id)
+	defer c.c.Text.EndResponse(id)
+	_, _, err = c.c.Text.ReadResponse(expect)
+	return err
+}
+
+func formatParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// the size of a buffered reader, or -1 when it is streamed
+func readerSize(r io.Reader) int64 {
+	if buffered, ok := r.(interface{ Len() int }); ok {
+		return int64(buffered.Len())
+	}
+	return -1
+}
+
+// the domain of an address, or empty when it cannot be parsed
 func extractDomain(email string) string {
 	addr, err := mail.ParseAddress(email)
 	if err != nil {
-		return "unknown_domain"
+		return ""
 	}
 	return addr.Address[strings.Index(addr.Address, "@")+1:]
 }
 
-func generateMessageID(from string) string {
+// the domain for generated Message-ID and Content-ID values: the local
+// name, else the From address domain, else localhost
+func idDomain(localName, from string) string {
+	if localName != "" {
+		return localName
+	}
+	if domain := extractDomain(from); domain != "" {
+		return domain
+	}
+	return "localhost"
+}
+
+// a new Message-ID without the angle brackets, which formatMessage adds
+func generateMessageID(localName, from string) string {
 	now := time.Now().UnixNano()
 	uuid := uuid.New().String()
-	mid := fmt.Sprintf("%d.%s@%s", now, uuid, extractDomain(from))
+	mid := fmt.Sprintf("%d.%s@%s", now, uuid, idDomain(localName, from))
 	return mid
 }
 
-func formatMessage(to, from, subject string, body []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("From: %s\r\n", from))
-	buf.WriteString(fmt.Sprintf("To: %s\r\n", to))
-	buf.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-	buf.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
-	buf.WriteString(fmt.Sprintf("Message-ID: %s\r\n", generateMessageID(from)))
-	buf.WriteString("Content-Type: text/plain; charset=\"us-ascii\"\r\n")
-	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
-	buf.WriteString("\r\n")
-	writer := quotedprintable.NewWriter(&buf)
-	_, err := writer.Write(body)
-	if err != nil {
-		return nil, Fatal(err)
+var hostFQDN struct {
+	once sync.Once
+	name string
+}
+
+// the smtp.local_name config value, else the host FQDN; empty when neither
+// is known.  The config is only read once Init has run.
+func localName(prefix string) string {
+	if programName != nil {
+		name := ViperGetString(prefix + "smtp.local_name")
+		if name != "" {
+			return name
+		}
+	}
+	hostFQDN.once.Do(func() {
+		fqdn, err := HostFQDN()
+		if err == nil {
+			hostFQDN.name = fqdn
+		}
+	})
+	return hostFQDN.name
+}
+
+// the name announced in EHLO; net/smtp sends localhost when none is set
+func (c *SendmailClient) helloName() string {
+	if c.LocalName == "" {
+		return "localhost"
 	}
-	writer.Close()
-	return buf.Bytes(), nil
+	return c.LocalName
 }
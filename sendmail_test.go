@@ -1,9 +1,19 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstms/go-common/smtptest"
 	"github.com/stretchr/testify/require"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSendmail(t *testing.T) {
@@ -38,4 +48,687 @@ func TestSendmail(t *testing.T) {
 	// send the mail
 	err = s.Send(to, from, subject, body)
 	require.Nil(t, err)
+
+	// send another message on the same session
+	err = s.Send(to, from, subject+" (2)", body)
+	require.Nil(t, err)
+
+	err = s.Close()
+	require.Nil(t, err)
+}
+
+func TestSendmailSecurity(t *testing.T) {
+
+	// the port selects the mode when it is not configured
+	for port, mode := range map[int]string{25: SMTP_SECURITY_OPPORTUNISTIC, 587: SMTP_SECURITY_STARTTLS, 465: SMTP_SECURITY_TLS, 2525: SMTP_SECURITY_TLS} {
+		c := SendmailClient{Host: "mail.example.com", Port: port}
+		require.Nil(t, c.setSecurity())
+		require.Equal(t, mode, c.Security)
+	}
+
+	// the mode selects the port when it is not given
+	for mode, port := range map[string]int{SMTP_SECURITY_TLS: 465, SMTP_SECURITY_STARTTLS: 587, SMTP_SECURITY_OPPORTUNISTIC: 25} {
+		c := SendmailClient{Host: "mail.example.com", Security: mode}
+		require.Nil(t, c.setSecurity())
+		require.Equal(t, port, c.Port)
+	}
+
+	// plaintext is only allowed to localhost
+	c := SendmailClient{Host: "mail.example.com", Security: SMTP_SECURITY_NONE}
+	require.NotNil(t, c.setSecurity())
+	c = SendmailClient{Host: "127.0.0.1", Security: SMTP_SECURITY_NONE}
+	require.Nil(t, c.setSecurity())
+	require.Equal(t, 25, c.Port)
+
+	c = SendmailClient{Host: "mail.example.com", Security: "bogus"}
+	require.NotNil(t, c.setSecurity())
+}
+
+func TestSelectAuthMechanism(t *testing.T) {
+	advertised := authMechanisms("PLAIN LOGIN CRAM-MD5 XOAUTH2")
+	mechanism, err := selectAuthMechanism("", advertised, false, true)
+	require.Nil(t, err)
+	require.Equal(t, SMTP_AUTH_PLAIN, mechanism)
+
+	mechanism, err = selectAuthMechanism(SMTP_AUTH_AUTO, advertised, false, false)
+	require.Nil(t, err)
+	require.Equal(t, SMTP_AUTH_CRAM_MD5, mechanism)
+
+	mechanism, err = selectAuthMechanism("", advertised, true, true)
+	require.Nil(t, err)
+	require.Equal(t, SMTP_AUTH_XOAUTH2, mechanism)
+
+	mechanism, err = selectAuthMechanism("", authMechanisms("LOGIN"), false, true)
+	require.Nil(t, err)
+	require.Equal(t, SMTP_AUTH_LOGIN, mechanism)
+
+	_, err = selectAuthMechanism(SMTP_AUTH_CRAM_MD5, authMechanisms("PLAIN LOGIN"), false, true)
+	require.NotNil(t, err)
+
+	mechanism, err = selectAuthMechanism(SMTP_AUTH_NONE, advertised, false, true)
+	require.Nil(t, err)
+	require.Equal(t, SMTP_AUTH_NONE, mechanism)
+}
+
+func TestFileTokenSource(t *testing.T) {
+	tokenFile, err := os.CreateTemp("", "token*")
+	require.Nil(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.Write([]byte("access-token\n"))
+	require.Nil(t, err)
+	require.Nil(t, tokenFile.Close())
+
+	token, err := FileTokenSource("@" + tokenFile.Name())()
+	require.Nil(t, err)
+	require.Equal(t, "access-token", token)
+
+	token, err = FileTokenSource("literal-token")()
+	require.Nil(t, err)
+	require.Equal(t, "literal-token", token)
+}
+
+func TestSendmailTransports(t *testing.T) {
+	initTestConfig(t)
+	defer ViperSet("smtp.transport", "")
+	msg := Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Bcc:     []string{"hidden@example.com"},
+		Subject: "transport test",
+		Body:    []byte("howdy\n"),
+	}
+
+	fileDir := t.TempDir()
+	ViperSet("smtp.transport", SMTP_TRANSPORT_FILE)
+	ViperSet("smtp.file_dir", fileDir)
+	s, err := NewSendmail("", 0, "", "", "")
+	require.Nil(t, err)
+	require.Nil(t, s.SendMessage(&msg))
+	require.Nil(t, s.Close())
+	files, err := filepath.Glob(filepath.Join(fileDir, "*.eml"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	require.Contains(t, string(data), "X-Envelope-To: rcpt@example.com, hidden@example.com\r\n")
+
+	maildir := filepath.Join(t.TempDir(), "Maildir")
+	ViperSet("smtp.transport", SMTP_TRANSPORT_MAILDIR)
+	ViperSet("smtp.maildir", maildir)
+	s, err = NewSendmail("", 0, "", "", "")
+	require.Nil(t, err)
+	require.Nil(t, s.Send("rcpt@example.com", "sender@example.com", "maildir test", []byte("howdy\n")))
+	files, err = filepath.Glob(filepath.Join(maildir, "new", "*"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err = os.ReadFile(files[0])
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(data), "Return-Path: <sender@example.com>\n"))
+	require.False(t, strings.Contains(string(data), "\r\n"))
+	require.Nil(t, s.SendRaw("sender@example.com", []string{"rcpt@example.com"}, strings.NewReader("Subject: raw\r\n\r\nhowdy\r\n")))
+	files, err = filepath.Glob(filepath.Join(maildir, "new", "*"))
+	require.Nil(t, err)
+	require.Len(t, files, 2)
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	outputDir := t.TempDir()
+	script := filepath.Join(outputDir, "sendmail")
+	err = os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >"+outputDir+"/args\ncat >"+outputDir+"/message\n"), 0700)
+	require.Nil(t, err)
+	ViperSet("smtp.transport", SMTP_TRANSPORT_SENDMAIL)
+	ViperSet("smtp.sendmail_path", script)
+	s, err = NewSendmail("", 0, "", "", "")
+	require.Nil(t, err)
+	require.Nil(t, s.SendMessage(&msg))
+	args, err := os.ReadFile(filepath.Join(outputDir, "args"))
+	require.Nil(t, err)
+	require.Equal(t, "-t -i -f sender@example.com\n", string(args))
+	data, err = os.ReadFile(filepath.Join(outputDir, "message"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "Subject: transport test\n")
+	require.Contains(t, string(data), "To: rcpt@example.com\n")
+	require.Contains(t, string(data), "Bcc: hidden@example.com\n")
+
+	// a raw message is sent to its given envelope
+	require.Nil(t, s.SendRaw("sender@example.com", []string{"rcpt@example.com"}, strings.NewReader("Subject: raw\r\n\r\nhowdy\r\n")))
+	args, err = os.ReadFile(filepath.Join(outputDir, "args"))
+	require.Nil(t, err)
+	require.Equal(t, "-i -f sender@example.com -- rcpt@example.com\n", string(args))
+}
+
+func TestSendmailFromConfigMissing(t *testing.T) {
+	initTestConfig(t)
+	_, err := NewSendmailFromConfig("missing.")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "missing config: go_common.missing.smtp.hostname")
+
+	ViperSet("missing.smtp.transport", SMTP_TRANSPORT_MAILDIR)
+	_, err = NewSendmailFromConfig("missing.")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "go_common.missing.smtp.maildir")
+
+	ViperSet("missing.smtp.maildir", filepath.Join(t.TempDir(), "Maildir"))
+	s, err := NewSendmailFromConfig("missing.")
+	require.Nil(t, err)
+	require.IsType(t, &SendmailMaildir{}, s)
+}
+
+func startTestServer(t *testing.T, mode string) *smtptest.Server {
+	server := smtptest.NewServer()
+	server.Username = "testuser"
+	server.Password = "testpass"
+	err := server.Start(mode)
+	require.Nil(t, err)
+	t.Cleanup(server.Close)
+	ViperSet("smtp.security", mode)
+	t.Cleanup(func() { ViperSet("smtp.security", "") })
+	return server
+}
+
+func TestSendmailSession(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_STARTTLS)
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		err = s.Send("rcpt@example.com", "sender@example.com", fmt.Sprintf("message %d", i), []byte("howdy\n"))
+		require.Nil(t, err)
+	}
+	require.Equal(t, 1, server.Connections())
+	messages := server.Messages()
+	require.Len(t, messages, 3)
+	for _, message := range messages {
+		require.True(t, message.TLS)
+		require.Equal(t, "testuser", message.Username)
+		require.Equal(t, "sender@example.com", message.From)
+		require.Equal(t, []string{"rcpt@example.com"}, message.Recipients)
+	}
+
+	// the client reconnects when the server drops the session
+	server.Drop()
+	err = s.Send("rcpt@example.com", "sender@example.com", "after drop", []byte("howdy\n"))
+	require.Nil(t, err)
+	require.Equal(t, 2, server.Connections())
+	require.Len(t, server.Messages(), 4)
+
+	require.Nil(t, s.Close())
+}
+
+func TestSendmailSecurityModes(t *testing.T) {
+	initTestConfig(t)
+	server := smtptest.NewServer()
+	require.Nil(t, server.Start(smtptest.MODE_STARTTLS))
+	defer server.Close()
+
+	// the test CA is not trusted without CAFile, so STARTTLS cannot verify
+	ViperSet("smtp.security", SMTP_SECURITY_STARTTLS)
+	defer ViperSet("smtp.security", "")
+	_, err := NewSendmail(server.Host, server.Port, "", "", "")
+	require.NotNil(t, err)
+
+	// opportunistic mode falls back to unverified TLS
+	ViperSet("smtp.security", SMTP_SECURITY_OPPORTUNISTIC)
+	s, err := NewSendmail(server.Host, server.Port, "", "", "")
+	require.Nil(t, err)
+	require.Nil(t, s.Send("rcpt@example.com", "sender@example.com", "fallback", []byte("howdy\n")))
+	require.Nil(t, s.Close())
+
+	// and uses TLS when it verifies
+	s, err = NewSendmail(server.Host, server.Port, "", "", server.CAFile)
+	require.Nil(t, err)
+	require.Nil(t, s.Send("rcpt@example.com", "sender@example.com", "verified", []byte("howdy\n")))
+	require.Nil(t, s.Close())
+
+	messages := server.Messages()
+	require.Len(t, messages, 2)
+	require.True(t, messages[0].TLS)
+	require.True(t, messages[1].TLS)
+
+	// credentials are only sent once the certificate verifies
+	auth := smtptest.NewServer()
+	auth.Username = "testuser"
+	auth.Password = "testpass"
+	require.Nil(t, auth.Start(smtptest.MODE_STARTTLS))
+	defer auth.Close()
+	s, err = NewSendmail(auth.Host, auth.Port, auth.Username, auth.Password, "")
+	require.Nil(t, err)
+	err = s.Send("rcpt@example.com", "sender@example.com", "unverified", []byte("howdy\n"))
+	var smtpErr *SMTPError
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_MAIL, smtpErr.Stage)
+	require.Equal(t, 530, smtpErr.Code)
+	require.Nil(t, s.Close())
+
+	s, err = NewSendmail(auth.Host, auth.Port, auth.Username, auth.Password, auth.CAFile)
+	require.Nil(t, err)
+	require.Nil(t, s.Send("rcpt@example.com", "sender@example.com", "verified", []byte("howdy\n")))
+	require.Nil(t, s.Close())
+	messages = auth.Messages()
+	require.Len(t, messages, 1)
+	require.True(t, messages[0].TLS)
+	require.Equal(t, "testuser", messages[0].Username)
+}
+
+func TestSendmailRecipientErrors(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	server.FailRecipient("unknown@example.com", 550, "5.1.1 mailbox unknown")
+	ViperSet("smtp.auth", SMTP_AUTH_LOGIN)
+	defer ViperSet("smtp.auth", "")
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+
+	err = s.SendMessage(&Message{
+		From:    "Sender <sender@example.com>",
+		To:      []string{"rcpt@example.com", "unknown@example.com"},
+		Cc:      []string{"copy@example.com"},
+		Bcc:     []string{"hidden@example.com"},
+		Subject: "partial",
+		Body:    []byte("howdy\n"),
+	})
+	var rcptErr *RecipientError
+	require.True(t, errors.As(err, &rcptErr))
+	require.Equal(t, []string{"rcpt@example.com", "copy@example.com", "hidden@example.com"}, rcptErr.Accepted)
+	require.Contains(t, rcptErr.Rejected, "unknown@example.com")
+
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	require.Equal(t, rcptErr.Accepted, messages[0].Recipients)
+	require.False(t, strings.Contains(string(messages[0].Data), "hidden@example.com"))
+}
+
+func TestSendmailLocalRelay(t *testing.T) {
+	initTestConfig(t)
+	server := smtptest.NewServer()
+	require.Nil(t, server.Start(smtptest.MODE_NONE))
+	defer server.Close()
+	ViperSet("smtp.security", SMTP_SECURITY_NONE)
+	defer ViperSet("smtp.security", "")
+
+	s, err := NewSendmail(server.Host, server.Port, "", "", "")
+	require.Nil(t, err)
+	defer s.Close()
+	err = s.Send("rcpt@example.com", "sender@example.com", "local relay", []byte("howdy\n"))
+	require.Nil(t, err)
+	require.Len(t, server.Messages(), 1)
+	require.False(t, server.Messages()[0].TLS)
+
+	_, err = NewSendmail("mail.example.com", 25, "", "", "")
+	require.NotNil(t, err)
+}
+
+func TestSendmailAuthMechanisms(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	defer ViperSet("smtp.auth", "")
+	for _, mechanism := range []string{SMTP_AUTH_PLAIN, SMTP_AUTH_LOGIN, SMTP_AUTH_CRAM_MD5, SMTP_AUTH_XOAUTH2} {
+		ViperSet("smtp.auth", mechanism)
+		s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+		require.Nil(t, err)
+		if mechanism == SMTP_AUTH_XOAUTH2 {
+			s.(*SendmailClient).TokenSource = FileTokenSource(server.Password)
+		}
+		err = s.Send("rcpt@example.com", "sender@example.com", mechanism, []byte("howdy\n"))
+		require.Nil(t, err, mechanism)
+		require.Nil(t, s.Close())
+	}
+
+	ViperSet("smtp.auth", SMTP_AUTH_PLAIN)
+	s, err := NewSendmail(server.Host, server.Port, server.Username, "wrong", server.CAFile)
+	require.Nil(t, err)
+	err = s.Send("rcpt@example.com", "sender@example.com", "bad password", []byte("howdy\n"))
+	require.NotNil(t, err)
+	s.Close()
+}
+
+func TestSendmailSMTPError(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	server.FailCount(smtptest.STAGE_MAIL, 451, "4.3.0 try again later", 1)
+	server.FailRecipient("unknown@example.com", 550, "5.1.1 mailbox unknown")
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+
+	err = s.Send("rcpt@example.com", "sender@example.com", "deferred", []byte("howdy\n"))
+	var smtpErr *SMTPError
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_MAIL, smtpErr.Stage)
+	require.Equal(t, 451, smtpErr.Code)
+	require.Equal(t, "4.3.0", smtpErr.EnhancedCode)
+	require.Equal(t, "try again later", smtpErr.Message)
+	require.True(t, smtpErr.IsTemporary())
+	require.False(t, smtpErr.IsPermanent())
+
+	err = s.Send("unknown@example.com", "sender@example.com", "rejected", []byte("howdy\n"))
+	var rcptErr *RecipientError
+	require.True(t, errors.As(err, &rcptErr))
+	require.True(t, errors.As(rcptErr.Rejected["unknown@example.com"], &smtpErr))
+	require.Equal(t, SMTP_STAGE_RCPT, smtpErr.Stage)
+	require.Equal(t, "5.1.1", smtpErr.EnhancedCode)
+	require.True(t, smtpErr.IsPermanent())
+	require.True(t, smtpErr.IsPermanentForMessage())
+
+	server.FailCount(smtptest.STAGE_MESSAGE, 554, "5.7.1 message refused", 1)
+	err = s.Send("rcpt@example.com", "sender@example.com", "refused", []byte("howdy\n"))
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_DATA, smtpErr.Stage)
+	require.Equal(t, 554, smtpErr.Code)
+
+	server.Close()
+	_, err = NewSendmail(server.Host, server.Port, server.Username, server.Password, "")
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_DIAL, smtpErr.Stage)
+	require.Equal(t, 0, smtpErr.Code)
+	require.True(t, smtpErr.IsTemporary())
+}
+
+func TestSendmailCapabilityErrors(t *testing.T) {
+	initTestConfig(t)
+	server := smtptest.NewServer()
+	server.Username = "testuser"
+	server.Password = "testpass"
+	server.AuthMechanisms = []string{"PLAIN"}
+	require.Nil(t, server.Start(smtptest.MODE_NONE))
+	defer server.Close()
+
+	// failures the client detects are permanent, like the reply they stand for;
+	// only those at the MAIL stage make a queued message a dead letter
+	var smtpErr *SMTPError
+	ViperSet("smtp.security", SMTP_SECURITY_STARTTLS)
+	defer ViperSet("smtp.security", "")
+	_, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, "")
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_DIAL, smtpErr.Stage)
+	require.True(t, smtpErr.IsPermanent())
+	require.False(t, smtpErr.IsPermanentForMessage())
+	require.False(t, isPermanentMailError(err))
+
+	ViperSet("smtp.security", SMTP_SECURITY_NONE)
+	ViperSet("smtp.auth", SMTP_AUTH_CRAM_MD5)
+	defer ViperSet("smtp.auth", "")
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, "")
+	require.Nil(t, err)
+	err = s.Send("rcpt@example.com", "sender@example.com", "no cram-md5", []byte("howdy\n"))
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_AUTH, smtpErr.Stage)
+	require.Equal(t, "5.5.4", smtpErr.EnhancedCode)
+	require.False(t, isPermanentMailError(err))
+	require.Nil(t, s.Close())
+
+	ViperSet("smtp.auth", "")
+	s, err = NewSendmail(server.Host, server.Port, server.Username, server.Password, "")
+	require.Nil(t, err)
+	defer s.Close()
+	err = s.Send("rcpt@example.com", "sender@exämple.com", "no smtputf8", []byte("howdy\n"))
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_MAIL, smtpErr.Stage)
+	require.Equal(t, 553, smtpErr.Code)
+	require.True(t, isPermanentMailError(err))
+	require.Empty(t, server.Messages())
+}
+
+func TestSendmailRaw(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	raw := "From: Sender <sender@example.com>\nTo: rcpt@example.com\nSubject: forwarded\n\nfirst line\n.leading dot\n"
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+	err = s.SendRaw("bounce@example.com", []string{"rcpt@example.com", "other@example.com"}, strings.NewReader(raw))
+	require.Nil(t, err)
+
+	ViperSet("smtp.raw_add_headers", true)
+	defer ViperSet("smtp.raw_add_headers", false)
+	s2, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s2.Close()
+	err = s2.SendRaw("bounce@example.com", []string{"rcpt@example.com"}, strings.NewReader("Date: Mon, 19 Oct 2026 08:00:00 +0000\r\nSubject: dated\r\n\r\nbody\r\n"))
+	require.Nil(t, err)
+
+	messages := server.Messages()
+	require.Len(t, messages, 2)
+	require.Equal(t, "bounce@example.com", messages[0].From)
+	require.Equal(t, []string{"rcpt@example.com", "other@example.com"}, messages[0].Recipients)
+	require.Equal(t, strings.ReplaceAll(raw, "\n", "\r\n"), string(messages[0].Data))
+
+	data := string(messages[1].Data)
+	require.True(t, strings.HasPrefix(data, "Message-ID: "))
+	require.Equal(t, 1, strings.Count(data, "Date: "))
+	require.True(t, strings.HasSuffix(data, "Subject: dated\r\n\r\nbody\r\n"))
+
+	err = s.SendRaw("bounce@example.com", nil, strings.NewReader(raw))
+	require.NotNil(t, err)
+
+	// an injected command is refused as a permanent failure
+	err = s.SendRaw("bounce@example.com>\r\nRSET\r\nMAIL FROM:<x@example.com", []string{"rcpt@example.com"}, strings.NewReader(raw))
+	var smtpErr *SMTPError
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, 501, smtpErr.Code)
+	require.True(t, isPermanentMailError(err))
+	err = s.SendRaw("bounce@example.com", []string{"rcpt@example.com\r\nRSET"}, strings.NewReader(raw))
+	require.True(t, isPermanentMailError(err))
+	require.Len(t, server.Messages(), 2)
+}
+
+func TestSendmailDSN(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_TLS)
+	server.Extensions = []string{"DSN", "SIZE 4096"}
+	ViperSet("smtp.dsn.notify", []string{"failure", "delay"})
+	defer ViperSet("smtp.dsn.notify", []string{})
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+
+	// the configured defaults
+	err = s.Send("rcpt@example.com", "sender@example.com", "defaults", []byte("howdy\n"))
+	require.Nil(t, err)
+
+	// options on the message replace the defaults
+	err = s.SendMessage(&Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "dsn",
+		Body:    []byte("howdy\n"),
+		DSN:     &DSNOptions{Notify: []string{"success", "failure"}, Return: "hdrs", EnvelopeID: "job=42 run+1"},
+	})
+	require.Nil(t, err)
+
+	messages := server.Messages()
+	require.Len(t, messages, 2)
+	require.Equal(t, []string{"NOTIFY=FAILURE,DELAY", "ORCPT=rfc822;rcpt@example.com"}, messages[0].RcptParams["rcpt@example.com"])
+	require.Len(t, messages[0].MailParams, 2)
+	require.Equal(t, fmt.Sprintf("SIZE=%d", len(messages[0].Data)), messages[0].MailParams[0])
+	require.Equal(t, "BODY=8BITMIME", messages[0].MailParams[1])
+	require.Equal(t, []string{"RET=HDRS", "ENVID=job+3D42+20run+2B1"}, messages[1].MailParams[2:])
+	require.Equal(t, []string{"NOTIFY=SUCCESS,FAILURE", "ORCPT=rfc822;rcpt@example.com"}, messages[1].RcptParams["rcpt@example.com"])
+
+	err = s.SendMessage(&Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "too big",
+		Body:    bytes.Repeat([]byte("0123456789abcdef\n"), 512),
+	})
+	var smtpErr *SMTPError
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, 552, smtpErr.Code)
+	require.True(t, smtpErr.IsPermanent())
+
+	err = s.SendMessage(&Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "invalid",
+		Body:    []byte("howdy\n"),
+		DSN:     &DSNOptions{Notify: []string{"never", "failure"}},
+	})
+	require.NotNil(t, err)
+	require.Len(t, server.Messages(), 2)
+}
+
+func TestSendmailContext(t *testing.T) {
+	initTestConfig(t)
+
+	// a relay that accepts connections but never sends a greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	ViperSet("smtp.security", SMTP_SECURITY_NONE)
+	defer ViperSet("smtp.security", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = NewSendmailContext(ctx, "127.0.0.1", port, "", "", "")
+	var smtpErr *SMTPError
+	require.True(t, errors.As(err, &smtpErr))
+	require.Equal(t, SMTP_STAGE_DIAL, smtpErr.Stage)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	ViperSet("smtp.command_timeout", 1)
+	defer ViperSet("smtp.command_timeout", 0)
+	start := time.Now()
+	_, err = NewSendmail("127.0.0.1", port, "", "", "")
+	require.True(t, errors.As(err, &smtpErr))
+	require.True(t, smtpErr.IsTemporary())
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	server := startTestServer(t, smtptest.MODE_STARTTLS)
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+	msg := Message{
+		From:    "sender@example.com",
+		To:      []string{"rcpt@example.com"},
+		Subject: "context",
+		Body:    []byte("howdy\n"),
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.SendContext(cancelled, &msg)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Empty(t, server.Messages())
+
+	// the session recovers on the next send
+	err = s.SendContext(context.Background(), &msg)
+	require.Nil(t, err)
+	require.Len(t, server.Messages(), 1)
+
+	// cancelling while the server stalls the AUTH reply aborts at once
+	ViperSet("smtp.command_timeout", 0)
+	s2, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s2.Close()
+	for _, call := range []func(ctx context.Context) error{
+		func(ctx context.Context) error { return s2.SendContext(ctx, &msg) },
+		func(ctx context.Context) error {
+			_, err := s2.(*SendmailClient).Verify(ctx)
+			return err
+		},
+	} {
+		server.Stall(smtptest.STAGE_AUTH, 2*time.Second, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start = time.Now()
+		err = call(ctx)
+		cancel()
+		require.True(t, errors.As(err, &smtpErr))
+		require.Equal(t, SMTP_STAGE_AUTH, smtpErr.Stage)
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Less(t, time.Since(start), time.Second)
+	}
+	require.Len(t, server.Messages(), 1)
+}
+
+func TestSendmailVerify(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_STARTTLS)
+	server.Extensions = []string{"DSN", "SIZE 1048576"}
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+	status, err := s.(*SendmailClient).Verify(context.Background())
+	require.Nil(t, err)
+	require.True(t, status.TLS)
+	require.Equal(t, SMTP_SECURITY_STARTTLS, status.Security)
+	require.NotEmpty(t, status.Auth)
+	require.Equal(t, "1048576", status.Extensions["SIZE"])
+	require.Contains(t, status.Extensions, "DSN")
+	require.Contains(t, status.Extensions, "AUTH")
+	require.Empty(t, server.Messages())
+}
+
+func TestSendmailLocalName(t *testing.T) {
+	initTestConfig(t)
+	server := startTestServer(t, smtptest.MODE_STARTTLS)
+	ViperSet("smtp.local_name", "mx.example.org")
+	defer ViperSet("smtp.local_name", "")
+
+	s, err := NewSendmail(server.Host, server.Port, server.Username, server.Password, server.CAFile)
+	require.Nil(t, err)
+	defer s.Close()
+	err = s.SendMessage(&Message{
+		From:       "Alice <alice@example.com>",
+		Sender:     "robot@example.net",
+		ReturnPath: "bounces@example.net",
+		To:         []string{"rcpt@example.com"},
+		Subject:    "identity",
+		Body:       []byte("howdy\n"),
+	})
+	require.Nil(t, err)
+	status, err := s.(*SendmailClient).Verify(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, "mx.example.org", status.LocalName)
+
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	require.Equal(t, "mx.example.org", messages[0].Helo)
+	require.Equal(t, "bounces@example.net", messages[0].From)
+	parsed, err := ParseMessage(bytes.NewReader(messages[0].Data))
+	require.Nil(t, err)
+	require.Equal(t, "alice@example.com", parsed.From[0].Address)
+	require.Equal(t, "robot@example.net", parsed.Sender.Address)
+	require.True(t, strings.HasSuffix(parsed.MessageID, "@mx.example.org"))
+	require.True(t, strings.HasPrefix(parsed.Header.Get("Message-ID"), "<"))
+	require.Empty(t, parsed.Header.Get("Return-Path"))
+
+	// a queue assigns Message-IDs with the sender's local name
+	q, err := NewMailQueue(t.TempDir(), s)
+	require.Nil(t, err)
+	require.Equal(t, "mx.example.org", q.LocalName)
+	_, err = q.Enqueue(&Message{From: "alice@example.com", To: []string{"rcpt@example.com"}, Body: []byte("howdy\n")})
+	require.Nil(t, err)
+	entries, err := q.List(false)
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(entries[0].Message.MessageID, "@mx.example.org"))
+
+	// and so do embedded parts
+	imageFile := filepath.Join(t.TempDir(), "logo.png")
+	require.Nil(t, os.WriteFile(imageFile, []byte("\x89PNG\r\n\x1a\nnot really"), 0600))
+	cid, err := (&Message{From: "alice@example.com"}).Embed(imageFile)
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(cid, "@mx.example.org"))
+
+	require.Equal(t, "mx.example.org", idDomain("mx.example.org", "alice@example.com"))
+	require.Equal(t, "example.com", idDomain("", "alice@example.com"))
+	require.Equal(t, "localhost", idDomain("", "not an address"))
 }
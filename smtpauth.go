@@ -0,0 +1,174 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP authentication mechanisms
+const SMTP_AUTH_AUTO = "auto"
+const SMTP_AUTH_NONE = "none"
+const SMTP_AUTH_PLAIN = "plain"
+const SMTP_AUTH_LOGIN = "login"
+const SMTP_AUTH_CRAM_MD5 = "cram-md5"
+const SMTP_AUTH_XOAUTH2 = "xoauth2"
+
+// TokenSource returns the current OAuth2 access token for XOAUTH2
+type TokenSource func() (string, error)
+
+// return a TokenSource for a literal token, or for a token read from a file
+// on each call when value is @pathname, so refreshed tokens are picked up
+func FileTokenSource(value string) TokenSource {
+	return func() (string, error) {
+		return readPassword(value)
+	}
+}
+
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %s", string(fromServer))
+}
+
+type xoauth2Auth struct {
+	username string
+	token    string
+	host     string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends a JSON error detail; an empty reply gets the final status
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// parse the mechanisms from the EHLO AUTH advertisement
+func authMechanisms(advertised string) map[string]bool {
+	mechanisms := make(map[string]bool)
+	for _, mechanism := range strings.Fields(advertised) {
+		mechanisms[strings.ToLower(mechanism)] = true
+	}
+	return mechanisms
+}
+
+// choose the mechanism to use, preferring XOAUTH2 when a token is configured
+// and challenge-response over an unencrypted connection
+func selectAuthMechanism(configured string, advertised map[string]bool, haveToken, isTLS bool) (string, error) {
+	switch configured {
+	case "", SMTP_AUTH_AUTO:
+	case SMTP_AUTH_NONE:
+		return SMTP_AUTH_NONE, nil
+	case SMTP_AUTH_PLAIN, SMTP_AUTH_LOGIN, SMTP_AUTH_CRAM_MD5, SMTP_AUTH_XOAUTH2:
+		if !advertised[configured] {
+			return "", newSMTPClientError(SMTP_STAGE_AUTH, 504, "5.5.4 server does not offer AUTH %s", strings.ToUpper(configured))
+		}
+		return configured, nil
+	default:
+		return "", newSMTPClientError(SMTP_STAGE_AUTH, 504, "5.5.4 unknown SMTP auth mechanism: %s", configured)
+	}
+	preferred := []string{SMTP_AUTH_PLAIN, SMTP_AUTH_LOGIN, SMTP_AUTH_CRAM_MD5}
+	if !isTLS {
+		preferred = []string{SMTP_AUTH_CRAM_MD5, SMTP_AUTH_PLAIN, SMTP_AUTH_LOGIN}
+	}
+	if haveToken {
+		preferred = []string{SMTP_AUTH_XOAUTH2}
+	}
+	for _, mechanism := range preferred {
+		if advertised[mechanism] {
+			return mechanism, nil
+		}
+	}
+	return "", newSMTPClientError(SMTP_STAGE_AUTH, 504, "5.5.4 no supported AUTH mechanism offered: %v", advertised)
+}
+
+// authenticate the session, skipping authentication when no credentials are
+// configured, the mechanism is none, or the server's certificate did not
+// verify, since credentials must not go to an unverified server
+func (c *SendmailClient) authenticate() error {
+	if c.Auth == SMTP_AUTH_NONE || (c.Username == "" && c.TokenSource == nil) || c.unverified {
+		return nil
+	}
+	ok, params := c.c.Extension("AUTH")
+	if !ok {
+		return newSMTPClientError(SMTP_STAGE_AUTH, 530, "5.7.0 server %s does not offer AUTH", c.Host)
+	}
+	_, isTLS := c.c.TLSConnectionState()
+	mechanism, err := selectAuthMechanism(c.Auth, authMechanisms(params), c.TokenSource != nil, isTLS)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	switch mechanism {
+	case SMTP_AUTH_NONE:
+		return nil
+	case SMTP_AUTH_XOAUTH2:
+		if c.TokenSource == nil {
+			return newSMTPClientError(SMTP_STAGE_AUTH, 530, "5.7.0 XOAUTH2 requires a token")
+		}
+		// a token or password that cannot be read may be refreshed later,
+		// so these carry no reply code and are not permanent
+		token, err := c.TokenSource()
+		if err != nil {
+			return newSMTPError(SMTP_STAGE_AUTH, err)
+		}
+		auth = &xoauth2Auth{username: c.Username, token: token, host: c.Host}
+	default:
+		password, err := readPassword(c.Password)
+		if err != nil {
+			return newSMTPError(SMTP_STAGE_AUTH, err)
+		}
+		switch mechanism {
+		case SMTP_AUTH_PLAIN:
+			auth = smtp.PlainAuth("", c.Username, password, c.Host)
+		case SMTP_AUTH_LOGIN:
+			auth = &loginAuth{username: c.Username, password: password, host: c.Host}
+		case SMTP_AUTH_CRAM_MD5:
+			auth = smtp.CRAMMD5Auth(c.Username, password)
+		}
+	}
+	err = c.c.Auth(auth)
+	if err != nil {
+		return newSMTPError(SMTP_STAGE_AUTH, fmt.Errorf("AUTH %s: %w", strings.ToUpper(mechanism), err))
+	}
+	c.mechanism = mechanism
+	return nil
+}
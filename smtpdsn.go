@@ -0,0 +1,100 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// values for DSNOptions.Notify
+const DSN_NOTIFY_NEVER = "never"
+const DSN_NOTIFY_SUCCESS = "success"
+const DSN_NOTIFY_FAILURE = "failure"
+const DSN_NOTIFY_DELAY = "delay"
+
+// values for DSNOptions.Return
+const DSN_RETURN_FULL = "full"
+const DSN_RETURN_HEADERS = "hdrs"
+
+// DSNOptions requests delivery status notifications (RFC 3461).  They are
+// sent only when the server advertises DSN; each recipient also carries an
+// ORCPT parameter so bounces can be matched to the address we sent to.
+type DSNOptions struct {
+	Notify     []string
+	Return     string
+	EnvelopeID string
+}
+
+// read the smtp.dsn section: notify, ret, and envid; nil if not configured
+func newDSNOptionsFromConfig(prefix string) (*DSNOptions, error) {
+	options := DSNOptions{
+		Notify:     ViperGetStringSlice(prefix + "smtp.dsn.notify"),
+		Return:     ViperGetString(prefix + "smtp.dsn.ret"),
+		EnvelopeID: ViperGetString(prefix + "smtp.dsn.envid"),
+	}
+	if len(options.Notify) == 0 && options.Return == "" && options.EnvelopeID == "" {
+		return nil, nil
+	}
+	err := options.validate()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return &options, nil
+}
+
+func (o *DSNOptions) validate() error {
+	for _, notify := range o.Notify {
+		switch strings.ToLower(notify) {
+		case DSN_NOTIFY_NEVER:
+			if len(o.Notify) > 1 {
+				return Fatalf("DSN notify '%s' cannot be combined with other values", DSN_NOTIFY_NEVER)
+			}
+		case DSN_NOTIFY_SUCCESS, DSN_NOTIFY_FAILURE, DSN_NOTIFY_DELAY:
+		default:
+			return Fatalf("unknown DSN notify value: %s", notify)
+		}
+	}
+	switch strings.ToLower(o.Return) {
+	case "", DSN_RETURN_FULL, DSN_RETURN_HEADERS:
+	default:
+		return Fatalf("unknown DSN return value: %s", o.Return)
+	}
+	return nil
+}
+
+// parameters for the MAIL command
+func (o *DSNOptions) mailParams() []string {
+	params := []string{}
+	if o.Return != "" {
+		params = append(params, "RET="+strings.ToUpper(o.Return))
+	}
+	if o.EnvelopeID != "" {
+		params = append(params, "ENVID="+xtext(o.EnvelopeID))
+	}
+	return params
+}
+
+// parameters for the RCPT command for one recipient
+func (o *DSNOptions) rcptParams(recipient string) []string {
+	params := []string{}
+	if len(o.Notify) > 0 {
+		params = append(params, "NOTIFY="+strings.ToUpper(strings.Join(o.Notify, ",")))
+	}
+	if isASCII(recipient) {
+		params = append(params, "ORCPT=rfc822;"+xtext(recipient))
+	}
+	return params
+}
+
+// encode a parameter value as RFC 3461 xtext
+func xtext(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			b.WriteString(fmt.Sprintf("+%02X", c))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// SMTP conversation stages reported by SMTPError
+const SMTP_STAGE_DIAL = "dial"
+const SMTP_STAGE_AUTH = "auth"
+const SMTP_STAGE_MAIL = "MAIL"
+const SMTP_STAGE_RCPT = "RCPT"
+const SMTP_STAGE_DATA = "DATA"
+const SMTP_STAGE_QUIT = "QUIT"
+
+var enhancedCodePattern = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s+`)
+
+// SMTPError describes a failed step of the SMTP conversation.  Code and
+// EnhancedCode are set when the server replied; a zero Code means the
+// connection itself failed.
+type SMTPError struct {
+	Stage        string
+	Code         int
+	EnhancedCode string
+	Message      string
+	Err          error
+}
+
+func newSMTPError(stage string, err error) *SMTPError {
+	e := SMTPError{Stage: stage, Err: err, Message: err.Error()}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		e.Code = protoErr.Code
+		e.Message = protoErr.Msg
+		match := enhancedCodePattern.FindStringSubmatch(e.Message)
+		if match != nil {
+			e.EnhancedCode = match[1]
+			e.Message = strings.TrimSpace(e.Message[len(match[0]):])
+		}
+	}
+	return &e
+}
+
+// an SMTPError for a failure the client detects itself, such as a missing
+// extension, carrying the reply the server would have sent so the error is
+// classified like one
+func newSMTPClientError(stage string, code int, format string, args ...interface{}) *SMTPError {
+	return newSMTPError(stage, &textproto.Error{Code: code, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (e *SMTPError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("SMTP %s failed: %s", e.Stage, e.Message)
+	}
+	if e.EnhancedCode != "" {
+		return fmt.Sprintf("SMTP %s failed: %d %s %s", e.Stage, e.Code, e.EnhancedCode, e.Message)
+	}
+	return fmt.Sprintf("SMTP %s failed: %d %s", e.Stage, e.Code, e.Message)
+}
+
+func (e *SMTPError) Unwrap() error {
+	return e.Err
+}
+
+// a 4xx reply or a network failure; the same message may succeed later
+func (e *SMTPError) IsTemporary() bool {
+	if e.Code == 0 {
+		var netErr net.Error
+		return errors.As(e.Err, &netErr) || errors.Is(e.Err, io.EOF) || errors.Is(e.Err, io.ErrUnexpectedEOF)
+	}
+	return e.Code >= 400 && e.Code < 500
+}
+
+// a 5xx reply at any stage; retrying the same command will not help.  A
+// 5xx while connecting or authenticating is a problem with the session,
+// not the message; use IsPermanentForMessage to decide whether to give up
+// on a message.
+func (e *SMTPError) IsPermanent() bool {
+	return e.Code >= 500
+}
+
+// a 5xx reply to the message itself, at the MAIL, RCPT, or DATA stage;
+// dial, STARTTLS, and AUTH failures may clear once the server or the
+// configuration is fixed, so the message is worth retrying
+func (e *SMTPError) IsPermanentForMessage() bool {
+	switch e.Stage {
+	case SMTP_STAGE_MAIL, SMTP_STAGE_RCPT, SMTP_STAGE_DATA:
+		return e.IsPermanent()
+	}
+	return false
+}
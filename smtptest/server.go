@@ -0,0 +1,644 @@
+// Package smtptest provides an in-process SMTP server for testing mail
+// clients.  It listens on localhost with optional implicit TLS or STARTTLS
+// using a generated certificate, accepts AUTH, records each message it
+// receives, and can inject failures at chosen protocol stages.
+package smtptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connection security modes accepted by Start
+const MODE_NONE = "none"
+const MODE_STARTTLS = "starttls"
+const MODE_TLS = "tls"
+
+// protocol stages at which a failure may be injected
+const STAGE_CONNECT = "connect"
+const STAGE_HELO = "helo"
+const STAGE_STARTTLS = "starttls"
+const STAGE_AUTH = "auth"
+const STAGE_MAIL = "mail"
+const STAGE_RCPT = "rcpt"
+const STAGE_DATA = "data"
+const STAGE_MESSAGE = "message"
+const STAGE_RESET = "rset"
+
+// Envelope is a message accepted by the server
+type Envelope struct {
+	Helo       string
+	Username   string
+	TLS        bool
+	From       string
+	MailParams []string
+	Recipients []string
+	RcptParams map[string][]string
+	Data       []byte
+}
+
+// Failure is a reply injected at a protocol stage; a zero Code drops the
+// connection instead of replying.  Count limits how many times it fires, with
+// zero meaning every time.  Delay holds the reply, as a hung server would; a
+// Delay with a zero Code stalls and then continues normally.
+type Failure struct {
+	Code    int
+	Message string
+	Count   int
+	Delay   time.Duration
+}
+
+// Server configuration fields must be set before Start.  AUTH is advertised
+// and required when Username is set; XOAUTH2 accepts Token, or Password when
+// Token is empty.
+type Server struct {
+	Addr           string
+	Host           string
+	Port           int
+	Hostname       string
+	Username       string
+	Password       string
+	Token          string
+	AuthMechanisms []string
+	Extensions     []string
+	CAFile         string
+	mode           string
+	listener       net.Listener
+	tlsConfig      *tls.Config
+	tempDir        string
+	mutex          sync.Mutex
+	envelopes      []Envelope
+	failures       map[string]*Failure
+	rcptFailures   map[string]*Failure
+	connections    int
+	conns          map[net.Conn]bool
+	wg             sync.WaitGroup
+}
+
+func NewServer() *Server {
+	return &Server{
+		Hostname:       "localhost",
+		AuthMechanisms: []string{"PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2"},
+		failures:       make(map[string]*Failure),
+		rcptFailures:   make(map[string]*Failure),
+		conns:          make(map[net.Conn]bool),
+	}
+}
+
+// listen on a random localhost port; for the TLS modes a self-signed CA
+// certificate is generated and written to CAFile
+func (s *Server) Start(mode string) error {
+	switch mode {
+	case MODE_NONE:
+	case MODE_STARTTLS, MODE_TLS:
+		err := s.generateCertificate()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mode: %s", mode)
+	}
+	s.mode = mode
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	if mode == MODE_TLS {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	s.Host = host
+	s.Port, err = strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// stop listening, drop open connections, and remove the generated CA file
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.Drop()
+	s.wg.Wait()
+	if s.tempDir != "" {
+		os.RemoveAll(s.tempDir)
+	}
+}
+
+// close all open client connections, as a server timing out would
+func (s *Server) Drop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// the messages accepted so far
+func (s *Server) Messages() []Envelope {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Envelope{}, s.envelopes...)
+}
+
+// the number of connections accepted so far
+func (s *Server) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connections
+}
+
+// discard recorded messages and injected failures
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.envelopes = nil
+	s.failures = make(map[string]*Failure)
+	s.rcptFailures = make(map[string]*Failure)
+}
+
+// reply with code and message at stage every time it is reached
+func (s *Server) Fail(stage string, code int, message string) {
+	s.FailCount(stage, code, message, 0)
+}
+
+// reply with code and message the next count times stage is reached
+func (s *Server) FailCount(stage string, code int, message string, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[stage] = &Failure{Code: code, Message: message, Count: count}
+}
+
+// hold the reply at stage for delay the next count times it is reached
+func (s *Server) Stall(stage string, delay time.Duration, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[stage] = &Failure{Delay: delay, Count: count}
+}
+
+// reject RCPT TO for one address
+func (s *Server) FailRecipient(address string, code int, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rcptFailures[strings.ToLower(address)] = &Failure{Code: code, Message: message}
+}
+
+// return the failure injected for key, consuming one use of it
+func (s *Server) takeFailure(failures map[string]*Failure, key string) *Failure {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	failure, ok := failures[key]
+	if !ok {
+		return nil
+	}
+	if failure.Count > 0 {
+		failure.Count--
+		if failure.Count == 0 {
+			delete(failures, key)
+		}
+	}
+	return failure
+}
+
+func (s *Server) generateCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "smtptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	s.tempDir, err = os.MkdirTemp("", "smtptest")
+	if err != nil {
+		return err
+	}
+	s.CAFile = filepath.Join(s.tempDir, "ca.pem")
+	return os.WriteFile(s.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.connections++
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// session is the state of one client connection
+type session struct {
+	server   *Server
+	conn     net.Conn
+	text     *textproto.Conn
+	isTLS    bool
+	helo     string
+	username string
+	envelope *Envelope
+}
+
+func (s *session) reply(code int, format string, args ...interface{}) error {
+	return s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// send the injected failure for stage if any, returning true if one was sent
+// and an error if the connection was dropped
+func (s *session) failed(stage string) (bool, error) {
+	failure := s.server.takeFailure(s.server.failures, stage)
+	if failure == nil {
+		return false, nil
+	}
+	if failure.Delay > 0 {
+		time.Sleep(failure.Delay)
+		if failure.Code == 0 {
+			return false, nil
+		}
+	}
+	if failure.Code == 0 {
+		s.conn.Close()
+		return true, fmt.Errorf("connection dropped at %s", stage)
+	}
+	return true, s.reply(failure.Code, "%s", failure.Message)
+}
+
+func (s *Server) handle(conn net.Conn) {
+	sess := session{server: s, conn: conn, text: textproto.NewConn(conn), isTLS: s.mode == MODE_TLS}
+	if failed, err := sess.failed(STAGE_CONNECT); failed || err != nil {
+		return
+	}
+	if sess.reply(220, "%s ESMTP smtptest", s.Hostname) != nil {
+		return
+	}
+	for {
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		err = sess.command(strings.ToUpper(verb), strings.TrimSpace(arg))
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errQuit = fmt.Errorf("quit")
+
+func (s *session) command(verb, arg string) error {
+	switch verb {
+	case "EHLO", "HELO":
+		return s.hello(verb, arg)
+	case "STARTTLS":
+		return s.startTLS()
+	case "AUTH":
+		return s.auth(arg)
+	case "MAIL":
+		return s.mail(arg)
+	case "RCPT":
+		return s.rcpt(arg)
+	case "DATA":
+		return s.data()
+	case "RSET":
+		if failed, err := s.failed(STAGE_RESET); failed || err != nil {
+			return err
+		}
+		s.envelope = nil
+		return s.reply(250, "OK")
+	case "NOOP":
+		return s.reply(250, "OK")
+	case "QUIT":
+		s.reply(221, "bye")
+		return errQuit
+	}
+	return s.reply(502, "command not implemented")
+}
+
+func (s *session) hello(verb, arg string) error {
+	if failed, err := s.failed(STAGE_HELO); failed || err != nil {
+		return err
+	}
+	s.helo = arg
+	s.envelope = nil
+	if verb == "HELO" {
+		return s.reply(250, "%s", s.server.Hostname)
+	}
+	lines := []string{s.server.Hostname, "PIPELINING", "8BITMIME"}
+	if s.server.mode == MODE_STARTTLS && !s.isTLS {
+		lines = append(lines, "STARTTLS")
+	}
+	if s.server.Username != "" && len(s.server.AuthMechanisms) > 0 {
+		lines = append(lines, "AUTH "+strings.Join(s.server.AuthMechanisms, " "))
+	}
+	lines = append(lines, s.server.Extensions...)
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		err := s.text.PrintfLine("250%s%s", separator, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) startTLS() error {
+	if s.server.mode != MODE_STARTTLS || s.isTLS {
+		return s.reply(502, "STARTTLS not available")
+	}
+	if failed, err := s.failed(STAGE_STARTTLS); failed || err != nil {
+		return err
+	}
+	err := s.reply(220, "ready to start TLS")
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Server(s.conn, s.server.tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	s.server.mutex.Lock()
+	delete(s.server.conns, s.conn)
+	s.server.conns[tlsConn] = true
+	s.server.mutex.Unlock()
+	s.conn = tlsConn
+	s.text = textproto.NewConn(tlsConn)
+	s.isTLS = true
+	s.helo = ""
+	s.envelope = nil
+	return nil
+}
+
+func (s *session) readAuthResponse(challenge string) (string, error) {
+	err := s.text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+	if err != nil {
+		return "", err
+	}
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "*" {
+		return "", fmt.Errorf("cancelled")
+	}
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (s *session) auth(arg string) error {
+	if s.server.Username == "" {
+		return s.reply(502, "AUTH not available")
+	}
+	if s.username != "" {
+		return s.reply(503, "already authenticated")
+	}
+	if failed, err := s.failed(STAGE_AUTH); failed || err != nil {
+		return err
+	}
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	mechanism = strings.ToUpper(mechanism)
+	offered := false
+	for _, m := range s.server.AuthMechanisms {
+		if strings.EqualFold(m, mechanism) {
+			offered = true
+		}
+	}
+	if !offered {
+		return s.reply(504, "unrecognized authentication type")
+	}
+	var username string
+	var ok bool
+	switch mechanism {
+	case "PLAIN":
+		var response string
+		if initial != "" {
+			data, err := base64.StdEncoding.DecodeString(initial)
+			if err != nil {
+				return s.reply(501, "invalid base64")
+			}
+			response = string(data)
+		} else {
+			var err error
+			response, err = s.readAuthResponse("")
+			if err != nil {
+				return s.reply(501, "%v", err)
+			}
+		}
+		parts := strings.Split(response, "\x00")
+		if len(parts) == 3 {
+			username = parts[1]
+			ok = username == s.server.Username && parts[2] == s.server.Password
+		}
+	case "LOGIN":
+		var err error
+		username, err = s.readAuthResponse("Username:")
+		if err != nil {
+			return s.reply(501, "%v", err)
+		}
+		password, err := s.readAuthResponse("Password:")
+		if err != nil {
+			return s.reply(501, "%v", err)
+		}
+		ok = username == s.server.Username && password == s.server.Password
+	case "CRAM-MD5":
+		challenge := fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), s.server.Hostname)
+		response, err := s.readAuthResponse(challenge)
+		if err != nil {
+			return s.reply(501, "%v", err)
+		}
+		var digest string
+		username, digest, _ = strings.Cut(response, " ")
+		mac := hmac.New(md5.New, []byte(s.server.Password))
+		mac.Write([]byte(challenge))
+		ok = username == s.server.Username && digest == hex.EncodeToString(mac.Sum(nil))
+	case "XOAUTH2":
+		data, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return s.reply(501, "invalid base64")
+		}
+		token := s.server.Token
+		if token == "" {
+			token = s.server.Password
+		}
+		for _, field := range strings.Split(string(data), "\x01") {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "user":
+				username = value
+			case "auth":
+				ok = value == "Bearer "+token
+			}
+		}
+		ok = ok && username == s.server.Username
+	default:
+		return s.reply(504, "unrecognized authentication type")
+	}
+	if !ok {
+		return s.reply(535, "authentication failed")
+	}
+	s.username = username
+	return s.reply(235, "authentication successful")
+}
+
+// split "FROM:<addr> PARAM..." into the address and parameters
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	fields := strings.Fields(strings.TrimSpace(arg[len(prefix):]))
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "<") || !strings.HasSuffix(fields[0], ">") {
+		return "", nil, false
+	}
+	return fields[0][1 : len(fields[0])-1], fields[1:], true
+}
+
+func (s *session) mail(arg string) error {
+	if s.helo == "" {
+		return s.reply(503, "send EHLO first")
+	}
+	if s.server.Username != "" && s.username == "" {
+		return s.reply(530, "authentication required")
+	}
+	if s.envelope != nil {
+		return s.reply(503, "nested MAIL command")
+	}
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		return s.reply(501, "syntax error in MAIL command")
+	}
+	if failed, err := s.failed(STAGE_MAIL); failed || err != nil {
+		return err
+	}
+	s.envelope = &Envelope{
+		Helo:       s.helo,
+		Username:   s.username,
+		TLS:        s.isTLS,
+		From:       from,
+		MailParams: params,
+		RcptParams: make(map[string][]string),
+	}
+	return s.reply(250, "OK")
+}
+
+func (s *session) rcpt(arg string) error {
+	if s.envelope == nil {
+		return s.reply(503, "need MAIL command")
+	}
+	to, params, ok := parsePath(arg, "TO:")
+	if !ok {
+		return s.reply(501, "syntax error in RCPT command")
+	}
+	if failed, err := s.failed(STAGE_RCPT); failed || err != nil {
+		return err
+	}
+	failure := s.server.takeFailure(s.server.rcptFailures, strings.ToLower(to))
+	if failure != nil {
+		return s.reply(failure.Code, "%s", failure.Message)
+	}
+	s.envelope.Recipients = append(s.envelope.Recipients, to)
+	s.envelope.RcptParams[to] = params
+	return s.reply(250, "OK")
+}
+
+func (s *session) data() error {
+	if s.envelope == nil || len(s.envelope.Recipients) == 0 {
+		return s.reply(503, "need RCPT command")
+	}
+	if failed, err := s.failed(STAGE_DATA); failed || err != nil {
+		return err
+	}
+	err := s.reply(354, "end data with <CR><LF>.<CR><LF>")
+	if err != nil {
+		return err
+	}
+	// read raw lines so the recorded message keeps its CRLF line endings
+	var data []byte
+	for {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line == "." {
+			break
+		}
+		line = strings.TrimPrefix(line, ".")
+		data = append(data, line...)
+		data = append(data, '\r', '\n')
+	}
+	envelope := s.envelope
+	s.envelope = nil
+	if failed, err := s.failed(STAGE_MESSAGE); failed || err != nil {
+		return err
+	}
+	envelope.Data = data
+	s.server.mutex.Lock()
+	s.server.envelopes = append(s.server.envelopes, *envelope)
+	s.server.mutex.Unlock()
+	return s.reply(250, "OK: queued")
+}